@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"src.agwa.name/sunglasses/proxy"
+)
+
+// configFile is the JSON configuration file format.  Top-level log fields
+// describe a single log, like the -id, -key, -submission, -monitoring,
+// -checkpoint, -origin, and -db flags; alternatively, Logs describes multiple
+// logs, like -log.
+type configFile struct {
+	configLog
+	Logs              []configLog `json:"logs"`
+	IssuerDB          *string     `json:"issuer_db"`
+	Listen            []string    `json:"listen"`
+	UserAgent         *string     `json:"user_agent"`
+	UnsafeNoFsync     *bool       `json:"unsafe_nofsync"`
+	NoLeafIndex       *bool       `json:"no_leaf_index"`
+	Frontend          *bool       `json:"frontend"`
+	ServeUnindexedSTH *bool       `json:"serve_unindexed_sth"`
+	VerifyEntries     *bool       `json:"verify_entries"`
+	VerifySCTs        *bool       `json:"verify_scts"`
+	Mirror            *bool       `json:"mirror"`
+	CertIndex         *bool       `json:"cert_index"`
+	DNSIndex          *bool       `json:"dns_index"`
+	PrecertIndex      *bool       `json:"precert_index"`
+	LocalProofs       *bool       `json:"local_proofs"`
+	AlertWebhooks     []string    `json:"alert_webhooks"`
+	AlertExec         []string    `json:"alert_exec"`
+	AlertFiles        []string    `json:"alert_files"`
+	PollInterval      *string     `json:"poll_interval"`
+	IndexWorkers      *int        `json:"index_workers"`
+	TileCacheSize     *int        `json:"tile_cache_size"`
+	GetEntriesTiles   *int        `json:"get_entries_tiles"`
+	MaxGetEntries     *int        `json:"max_get_entries"`
+	ReadyMaxLag       *uint64     `json:"ready_max_lag"`
+	ReadyMaxStaleness *string     `json:"ready_max_staleness"`
+	MMD               *string     `json:"mmd"`
+	Witnesses         []string    `json:"witnesses"`
+	WitnessQuorum     *int        `json:"witness_quorum"`
+	WitnessMaxAge     *string     `json:"witness_max_age"`
+}
+
+type configLog struct {
+	Host       string `json:"host"`
+	Path       string `json:"path"`
+	ID         string `json:"id"`
+	Key        string `json:"key"`
+	Submission string `json:"submission"`
+	Monitoring string `json:"monitoring"`
+	Checkpoint string `json:"checkpoint"`
+	Origin     string `json:"origin"`
+	DB         string `json:"db"`
+}
+
+// fieldError is a validation error for a particular field of the configuration file
+type fieldError struct {
+	field string
+	err   error
+}
+
+func (e *fieldError) Error() string {
+	return e.field + ": " + e.err.Error()
+}
+
+func (e *fieldError) Unwrap() error {
+	return e.err
+}
+
+// resolvePath interprets path relative to dir, the directory containing the
+// configuration file.  PostgreSQL connection URLs are left alone.
+func resolvePath(dir string, path string) string {
+	if path == "" || filepath.IsAbs(path) || strings.Contains(path, "://") {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func (cl *configLog) toSpec(prefix string, dir string) (*logSpec, error) {
+	spec := new(logSpec)
+	spec.host = cl.Host
+	spec.path = cleanPath(cl.Path)
+	spec.db = resolvePath(dir, cl.DB)
+	spec.origin = cl.Origin
+	if cl.ID != "" {
+		if err := parseLogIDFunc(&spec.id)(cl.ID); err != nil {
+			return nil, &fieldError{prefix + "id", err}
+		}
+	}
+	if cl.Key != "" {
+		if err := readFileFunc(&spec.key)(resolvePath(dir, cl.Key)); err != nil {
+			return nil, &fieldError{prefix + "key", err}
+		}
+	}
+	if cl.Submission != "" {
+		if err := parseURLFunc(&spec.submission)(cl.Submission); err != nil {
+			return nil, &fieldError{prefix + "submission", err}
+		}
+	}
+	if cl.Monitoring != "" {
+		if err := parseURLFunc(&spec.monitoring)(cl.Monitoring); err != nil {
+			return nil, &fieldError{prefix + "monitoring", err}
+		}
+	}
+	if cl.Checkpoint != "" {
+		if err := parseURLFunc(&spec.checkpoint)(cl.Checkpoint); err != nil {
+			return nil, &fieldError{prefix + "checkpoint", err}
+		}
+	}
+	return spec, nil
+}
+
+func (cl *configLog) isEmpty() bool {
+	return *cl == configLog{}
+}
+
+// loadConfigFile loads the configuration file at path into opts.  Options
+// whose flags are in explicit were set on the command line and are not
+// overridden.  Relative paths in the file are relative to its directory.
+func loadConfigFile(path string, opts *options, explicit map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file configFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return fmt.Errorf("%s:%d: %w", path, 1+bytes.Count(data[:syntaxErr.Offset], []byte{'\n'}), err)
+		}
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := file.apply(opts, explicit, filepath.Dir(path)); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func (file *configFile) apply(opts *options, explicit map[string]bool, dir string) error {
+	if file.Host != "" || file.Path != "" {
+		return &fieldError{"host", errors.New("host and path are only allowed in logs")}
+	}
+	if !file.configLog.isEmpty() && len(file.Logs) > 0 {
+		return &fieldError{"logs", errors.New("cannot be used with top-level id, key, submission, monitoring, checkpoint, origin, or db")}
+	}
+
+	single, err := file.configLog.toSpec("", dir)
+	if err != nil {
+		return err
+	}
+	if !explicit["id"] && single.id != (proxy.LogID{}) {
+		opts.single.id = single.id
+	}
+	if !explicit["key"] && single.key != nil {
+		opts.single.key = single.key
+	}
+	if !explicit["submission"] && single.submission != nil {
+		opts.single.submission = single.submission
+	}
+	if !explicit["monitoring"] && single.monitoring != nil {
+		opts.single.monitoring = single.monitoring
+	}
+	if !explicit["checkpoint"] && single.checkpoint != nil {
+		opts.single.checkpoint = single.checkpoint
+	}
+	if !explicit["origin"] && single.origin != "" {
+		opts.single.origin = single.origin
+	}
+	if !explicit["db"] && single.db != "" {
+		opts.single.db = single.db
+	}
+
+	if !explicit["log"] {
+		for i := range file.Logs {
+			prefix := fmt.Sprintf("logs[%d].", i)
+			spec, err := file.Logs[i].toSpec(prefix, dir)
+			if err != nil {
+				return err
+			}
+			if spec.host == "" && spec.path == "" {
+				return &fieldError{prefix + "path", errors.New("host or path is required")}
+			}
+			if err := spec.validate(); err != nil {
+				return &fieldError{prefix[:len(prefix)-1], err}
+			}
+			opts.logs = append(opts.logs, spec)
+		}
+	}
+
+	if !explicit["issuer-db"] && file.IssuerDB != nil {
+		opts.issuerDB = resolvePath(dir, *file.IssuerDB)
+	}
+	if !explicit["listen"] && file.Listen != nil {
+		opts.listen = file.Listen
+	}
+	if !explicit["alert-webhook"] && file.AlertWebhooks != nil {
+		opts.alertWebhooks = file.AlertWebhooks
+	}
+	if !explicit["alert-exec"] && file.AlertExec != nil {
+		opts.alertExec = file.AlertExec
+	}
+	if !explicit["alert-file"] && file.AlertFiles != nil {
+		opts.alertFiles = file.AlertFiles
+	}
+	if !explicit["user-agent"] && file.UserAgent != nil {
+		opts.userAgent = *file.UserAgent
+	}
+	if !explicit["unsafe-nofsync"] && file.UnsafeNoFsync != nil {
+		opts.unsafeNoFsync = *file.UnsafeNoFsync
+	}
+	if !explicit["no-leaf-index"] && file.NoLeafIndex != nil {
+		opts.noLeafIndex = *file.NoLeafIndex
+	}
+	if !explicit["frontend"] && file.Frontend != nil {
+		opts.frontend = *file.Frontend
+	}
+	if !explicit["serve-unindexed-sth"] && file.ServeUnindexedSTH != nil {
+		opts.serveUnindexedSTH = *file.ServeUnindexedSTH
+	}
+	if !explicit["verify-entries"] && file.VerifyEntries != nil {
+		opts.verifyEntries = *file.VerifyEntries
+	}
+	if !explicit["verify-scts"] && file.VerifySCTs != nil {
+		opts.verifySCTs = *file.VerifySCTs
+	}
+	if !explicit["mirror"] && file.Mirror != nil {
+		opts.mirror = *file.Mirror
+	}
+	if !explicit["cert-index"] && file.CertIndex != nil {
+		opts.certIndex = *file.CertIndex
+	}
+	if !explicit["dns-index"] && file.DNSIndex != nil {
+		opts.dnsIndex = *file.DNSIndex
+	}
+	if !explicit["precert-index"] && file.PrecertIndex != nil {
+		opts.precertIndex = *file.PrecertIndex
+	}
+	if !explicit["local-proofs"] && file.LocalProofs != nil {
+		opts.localProofs = *file.LocalProofs
+	}
+	if !explicit["poll-interval"] && file.PollInterval != nil {
+		if d, err := time.ParseDuration(*file.PollInterval); err != nil {
+			return &fieldError{"poll_interval", err}
+		} else if d <= 0 {
+			return &fieldError{"poll_interval", errors.New("must be positive")}
+		} else {
+			opts.pollInterval = d
+		}
+	}
+	if !explicit["index-workers"] && file.IndexWorkers != nil {
+		if *file.IndexWorkers <= 0 {
+			return &fieldError{"index_workers", errors.New("must be positive")}
+		}
+		opts.indexWorkers = *file.IndexWorkers
+	}
+	if !explicit["tile-cache-size"] && file.TileCacheSize != nil {
+		if *file.TileCacheSize <= 0 {
+			return &fieldError{"tile_cache_size", errors.New("must be positive")}
+		}
+		opts.tileCacheSize = *file.TileCacheSize
+	}
+	if !explicit["get-entries-tiles"] && file.GetEntriesTiles != nil {
+		if *file.GetEntriesTiles <= 0 {
+			return &fieldError{"get_entries_tiles", errors.New("must be positive")}
+		}
+		opts.getEntriesTiles = *file.GetEntriesTiles
+	}
+	if !explicit["max-get-entries"] && file.MaxGetEntries != nil {
+		if *file.MaxGetEntries < 0 {
+			return &fieldError{"max_get_entries", errors.New("must not be negative")}
+		}
+		opts.maxGetEntries = *file.MaxGetEntries
+	}
+	if !explicit["ready-max-lag"] && file.ReadyMaxLag != nil {
+		opts.readyMaxLag = *file.ReadyMaxLag
+	}
+	if !explicit["ready-max-staleness"] && file.ReadyMaxStaleness != nil {
+		if d, err := time.ParseDuration(*file.ReadyMaxStaleness); err != nil {
+			return &fieldError{"ready_max_staleness", err}
+		} else if d < 0 {
+			return &fieldError{"ready_max_staleness", errors.New("must not be negative")}
+		} else {
+			opts.readyMaxStale = d
+		}
+	}
+	if !explicit["witness"] && file.Witnesses != nil {
+		opts.witnesses = file.Witnesses
+	}
+	if !explicit["witness-quorum"] && file.WitnessQuorum != nil {
+		if *file.WitnessQuorum < 0 {
+			return &fieldError{"witness_quorum", errors.New("must not be negative")}
+		}
+		opts.witnessQuorum = *file.WitnessQuorum
+	}
+	if !explicit["witness-max-age"] && file.WitnessMaxAge != nil {
+		if d, err := time.ParseDuration(*file.WitnessMaxAge); err != nil {
+			return &fieldError{"witness_max_age", err}
+		} else if d <= 0 {
+			return &fieldError{"witness_max_age", errors.New("must be positive")}
+		} else {
+			opts.witnessMaxAge = d
+		}
+	}
+	if !explicit["mmd"] && file.MMD != nil {
+		if d, err := time.ParseDuration(*file.MMD); err != nil {
+			return &fieldError{"mmd", err}
+		} else if d <= 0 {
+			return &fieldError{"mmd", errors.New("must be positive")}
+		} else {
+			opts.mmd = d
+		}
+	}
+	return nil
+}
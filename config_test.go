@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes a configuration file with the given contents to a
+// new directory and returns its path
+func writeConfigFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "sunglasses.json")
+	if err := os.WriteFile(path, []byte(contents), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFileRelativePaths(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"key": "keys/log.pem",
+		"submission": "https://example.com/log/",
+		"monitoring": "https://example.com/log/",
+		"db": "sunglasses.db",
+		"issuer_db": "/var/lib/sunglasses/issuers.db"
+	}`)
+	dir := filepath.Dir(path)
+	key := []byte("-----BEGIN PUBLIC KEY-----\n")
+	if err := os.Mkdir(filepath.Join(dir, "keys"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "keys", "log.pem"), key, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	var opts options
+	if err := loadConfigFile(path, &opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opts.single.key, key) {
+		t.Errorf("key wasn't read relative to the configuration file: %q", opts.single.key)
+	}
+	if want := filepath.Join(dir, "sunglasses.db"); opts.single.db != want {
+		t.Errorf("db is %q, want %q", opts.single.db, want)
+	}
+	if opts.issuerDB != "/var/lib/sunglasses/issuers.db" {
+		t.Errorf("absolute issuer_db was changed to %q", opts.issuerDB)
+	}
+
+	path = writeConfigFile(t, `{"logs": [
+		{"path": "/a/", "id": "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=", "submission": "https://a.example/", "monitoring": "https://a.example/", "db": "postgres://localhost/a"},
+		{"path": "b", "id": "AgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgI=", "submission": "https://b.example/", "monitoring": "https://b.example/", "db": "b.db"}
+	]}`)
+	opts = options{}
+	if err := loadConfigFile(path, &opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.logs) != 2 {
+		t.Fatalf("loaded %d logs", len(opts.logs))
+	}
+	if opts.logs[0].db != "postgres://localhost/a" {
+		t.Errorf("PostgreSQL URL was changed to %q", opts.logs[0].db)
+	}
+	if want := filepath.Join(filepath.Dir(path), "b.db"); opts.logs[1].db != want {
+		t.Errorf("logs[1].db is %q, want %q", opts.logs[1].db, want)
+	}
+	if opts.logs[0].path != "/a" || opts.logs[1].path != "/b" {
+		t.Errorf("log paths weren't cleaned: %q, %q", opts.logs[0].path, opts.logs[1].path)
+	}
+}
+
+func TestConfigFileFlagsOverride(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"db": "file.db",
+		"listen": ["tcp:8080"],
+		"poll_interval": "30s",
+		"index_workers": 4,
+		"mirror": true,
+		"cert_index": true
+	}`)
+	logsPath := writeConfigFile(t, `{
+		"logs": [{"path": "/log", "id": "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=", "submission": "https://example.com/", "monitoring": "https://example.com/"}]
+	}`)
+
+	// register some of the flags like main does, and determine which
+	// were set on the command line the same way
+	var opts options
+	flags := flag.NewFlagSet("sunglasses", flag.ContinueOnError)
+	flags.StringVar(&opts.single.db, "db", "", "")
+	flags.Func("log", "", func(arg string) error {
+		spec, err := parseLogSpec(arg)
+		if err != nil {
+			return err
+		}
+		opts.logs = append(opts.logs, spec)
+		return nil
+	})
+	flags.Func("listen", "", func(arg string) error {
+		opts.listen = append(opts.listen, arg)
+		return nil
+	})
+	flags.DurationVar(&opts.pollInterval, "poll-interval", time.Minute, "")
+	flags.IntVar(&opts.indexWorkers, "index-workers", 500, "")
+	flags.BoolVar(&opts.mirror, "mirror", false, "")
+	flags.BoolVar(&opts.certIndex, "cert-index", false, "")
+	args := []string{
+		"-db", "flag.db",
+		"-log", "path=/other,id=AgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgI=,submission=https://example.org/,monitoring=https://example.org/",
+		"-listen", "tcp:9090",
+		"-poll-interval", "5s",
+		"-mirror=false",
+	}
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if err := loadConfigFile(path, &opts, explicit); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(logsPath, &opts, explicit); err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.single.db != "flag.db" {
+		t.Errorf("db is %q, want the flag's value", opts.single.db)
+	}
+	if len(opts.logs) != 1 || opts.logs[0].path != "/other" {
+		t.Errorf("logs from the file were used along with -log")
+	}
+	if !slices.Equal(opts.listen, []string{"tcp:9090"}) {
+		t.Errorf("listen is %q, want the flag's value", opts.listen)
+	}
+	if opts.pollInterval != 5*time.Second {
+		t.Errorf("poll interval is %s, want the flag's value", opts.pollInterval)
+	}
+	if opts.mirror {
+		t.Error("mirror was enabled by the file even though -mirror=false was specified")
+	}
+	// flags which weren't specified take their values from the file, not their defaults
+	if opts.indexWorkers != 4 {
+		t.Errorf("index workers is %d, want the file's value", opts.indexWorkers)
+	}
+	if !opts.certIndex {
+		t.Error("cert_index from the file wasn't used")
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	const logID = `"AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="`
+	tests := []struct {
+		name     string
+		contents string
+		field    string // empty if the error isn't a fieldError
+		message  string // error message following the configuration file path
+	}{
+		{"unknown field", `{"poll_interval": "1m", "pol_interval": "1m"}`, "", `: json: unknown field "pol_interval"`},
+		{"unknown log field", `{"logs": [{"path": "/log", "ids": ` + logID + `}]}`, "", `: json: unknown field "ids"`},
+		{"syntax error", "{\n\t\"mirror\": true,\n}", "", `:3: invalid character '}' looking for beginning of object key string`},
+		{"bad duration", `{"poll_interval": "soon"}`, "poll_interval", `: poll_interval: time: invalid duration "soon"`},
+		{"non-positive duration", `{"mmd": "0s"}`, "mmd", ": mmd: must be positive"},
+		{"negative duration", `{"ready_max_staleness": "-1m"}`, "ready_max_staleness", ": ready_max_staleness: must not be negative"},
+		{"non-positive count", `{"index_workers": 0}`, "index_workers", ": index_workers: must be positive"},
+		{"negative count", `{"witness_quorum": -1}`, "witness_quorum", ": witness_quorum: must not be negative"},
+		{"bad log ID", `{"id": "AQEB"}`, "id", ": id: wrong length for Log ID"},
+		{"bad URL", `{"submission": "https://example.com/%zz"}`, "submission", `: submission: parse "https://example.com/%zz": invalid URL escape "%zz"`},
+		{"top-level host", `{"host": "example.com"}`, "host", ": host: host and path are only allowed in logs"},
+		{"logs with top-level log", `{"id": ` + logID + `, "logs": [{"path": "/log"}]}`, "logs", ": logs: cannot be used with top-level id, key, submission, monitoring, checkpoint, origin, or db"},
+		{"log without path", `{"logs": [{"id": ` + logID + `}]}`, "logs[0].path", ": logs[0].path: host or path is required"},
+		{"bad log ID in logs", `{"logs": [{"path": "/a", "id": ` + logID + `, "submission": "https://a.example/", "monitoring": "https://a.example/"}, {"path": "/b", "id": "AQEB"}]}`, "logs[1].id", ": logs[1].id: wrong length for Log ID"},
+		{"incomplete log", `{"logs": [{"path": "/log", "id": ` + logID + `}]}`, "logs[0]", ": logs[0]: submission is required"},
+	}
+	for _, test := range tests {
+		path := writeConfigFile(t, test.contents)
+		err := loadConfigFile(path, new(options), nil)
+		if err == nil {
+			t.Errorf("%s: loadConfigFile succeeded", test.name)
+			continue
+		}
+		if want := path + test.message; err.Error() != want {
+			t.Errorf("%s: error is %q, want %q", test.name, err, want)
+		}
+		var fieldErr *fieldError
+		if !errors.As(err, &fieldErr) {
+			if test.field != "" {
+				t.Errorf("%s: error isn't a fieldError", test.name)
+			}
+		} else if fieldErr.field != test.field {
+			t.Errorf("%s: error is for field %q, want %q", test.name, fieldErr.field, test.field)
+		}
+	}
+
+	path := writeConfigFile(t, `{"key": "missing.pem"}`)
+	if err := loadConfigFile(path, new(options), nil); err == nil || !strings.Contains(err.Error(), "key: open "+filepath.Join(filepath.Dir(path), "missing.pem")+":") {
+		t.Errorf("error for missing key doesn't name its resolved path: %v", err)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("error for missing key doesn't wrap os.ErrNotExist: %v", err)
+	}
+	if err := loadConfigFile(filepath.Join(t.TempDir(), "missing.json"), new(options), nil); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("loading a missing configuration file returned %v", err)
+	}
+}
@@ -3,6 +3,7 @@ module src.agwa.name/sunglasses
 go 1.24.4
 
 require (
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.24
 	golang.org/x/crypto v0.39.0
 	golang.org/x/mod v0.25.0
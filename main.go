@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"runtime/debug"
+	"strings"
+	"syscall"
 	"time"
 
+	"golang.org/x/sync/errgroup"
 	"src.agwa.name/go-listener"
 	_ "src.agwa.name/go-listener/tls"
 
@@ -41,6 +46,17 @@ func parseLogIDFunc(out *proxy.LogID) func(string) error {
 	}
 }
 
+func readFileFunc(out *[]byte) func(string) error {
+	return func(arg string) error {
+		if b, err := os.ReadFile(arg); err != nil {
+			return err
+		} else {
+			*out = b
+			return nil
+		}
+	}
+}
+
 func defaultUserAgent() string {
 	if info, ok := debug.ReadBuildInfo(); ok {
 		return info.Main.Path + " " + info.Main.Version
@@ -48,60 +64,331 @@ func defaultUserAgent() string {
 	return ""
 }
 
+// logSpec describes one of the logs served by this process
+type logSpec struct {
+	host       string // if non-empty, only serve requests with this Host header
+	path       string // if non-empty, serve requests under this path prefix (no trailing slash)
+	id         proxy.LogID
+	key        []byte
+	submission *url.URL
+	monitoring *url.URL
+	checkpoint *url.URL // if non-nil, download cosigned checkpoints from here
+	origin     string   // if non-empty, expected checkpoint origin
+	db         string
+}
+
+func parseLogSpec(arg string) (*logSpec, error) {
+	spec := new(logSpec)
+	for field := range strings.SplitSeq(arg, ",") {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not of the form NAME=VALUE", field)
+		}
+		var err error
+		switch name {
+		case "host":
+			spec.host = value
+		case "path":
+			spec.path = cleanPath(value)
+		case "id":
+			err = parseLogIDFunc(&spec.id)(value)
+		case "key":
+			err = readFileFunc(&spec.key)(value)
+		case "submission":
+			err = parseURLFunc(&spec.submission)(value)
+		case "monitoring":
+			err = parseURLFunc(&spec.monitoring)(value)
+		case "checkpoint":
+			err = parseURLFunc(&spec.checkpoint)(value)
+		case "origin":
+			spec.origin = value
+		case "db":
+			spec.db = value
+		default:
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if spec.host == "" && spec.path == "" {
+		return nil, fmt.Errorf("host or path is required")
+	}
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+func (spec *logSpec) validate() error {
+	if spec.id == (proxy.LogID{}) && spec.key == nil {
+		return fmt.Errorf("id or key is required")
+	}
+	if spec.submission == nil {
+		return fmt.Errorf("submission is required")
+	}
+	if spec.monitoring == nil {
+		return fmt.Errorf("monitoring is required")
+	}
+	return nil
+}
+
+func cleanPath(path string) string {
+	if trimmed := strings.Trim(path, "/"); trimmed != "" {
+		return "/" + trimmed
+	}
+	return ""
+}
+
+// pattern returns the http.ServeMux pattern which matches requests for this log
+func (spec *logSpec) pattern() string {
+	return spec.host + spec.path + "/"
+}
+
+type options struct {
+	single            logSpec
+	logs              []*logSpec
+	issuerDB          string
+	listen            []string
+	userAgent         string
+	unsafeNoFsync     bool
+	noLeafIndex       bool
+	frontend          bool
+	serveUnindexedSTH bool
+	verifyEntries     bool
+	verifySCTs        bool
+	mirror            bool
+	certIndex         bool
+	dnsIndex          bool
+	precertIndex      bool
+	localProofs       bool
+	alertWebhooks     []string
+	alertExec         []string
+	alertFiles        []string
+	pollInterval      time.Duration
+	indexWorkers      int
+	tileCacheSize     int
+	getEntriesTiles   int
+	maxGetEntries     int
+	readyMaxLag       uint64
+	readyMaxStale     time.Duration
+	mmd               time.Duration
+	witnesses         []string
+	witnessQuorum     int
+	witnessMaxAge     time.Duration
+}
+
 func main() {
-	var flags struct {
-		submission    *url.URL
-		monitoring    *url.URL
-		id            proxy.LogID
-		db            string
-		listen        []string
-		userAgent     string
-		unsafeNoFsync bool
-		noLeafIndex   bool
-	}
-	flag.StringVar(&flags.db, "db", "", "`PATH` to database file (will be created if necessary)")
-	flag.Func("id", "Log ID `BASE64`", parseLogIDFunc(&flags.id))
-	flag.Func("submission", "Submission prefix `URL`", parseURLFunc(&flags.submission))
-	flag.Func("monitoring", "Monitoring prefix `URL`", parseURLFunc(&flags.monitoring))
+	var configPath string
+	var flags options
+	flag.StringVar(&configPath, "config", "", "`PATH` to JSON configuration file (flags override values in the file)")
+	flag.StringVar(&flags.single.db, "db", "", "`PATH` to database file (will be created if necessary)")
+	flag.Func("id", "Log ID `BASE64`", parseLogIDFunc(&flags.single.id))
+	flag.Func("key", "`PATH` to log's public key (PEM or DER)", readFileFunc(&flags.single.key))
+	flag.Func("submission", "Submission prefix `URL`", parseURLFunc(&flags.single.submission))
+	flag.Func("monitoring", "Monitoring prefix `URL`", parseURLFunc(&flags.single.monitoring))
+	flag.Func("checkpoint", "`URL` of a witness or distributor to download cosigned checkpoints from (default: the log's checkpoint)", parseURLFunc(&flags.single.checkpoint))
+	flag.StringVar(&flags.single.origin, "origin", "", "expected `ORIGIN` line of the log's checkpoints (default: submission prefix without the scheme)")
+	flag.Func("log", "Serve the log described by `SPEC` (repeatable; see README)", func(arg string) error {
+		if spec, err := parseLogSpec(arg); err != nil {
+			return err
+		} else {
+			flags.logs = append(flags.logs, spec)
+			return nil
+		}
+	})
+	flag.StringVar(&flags.issuerDB, "issuer-db", "", "`PATH` to database file for caching issuers of all logs (will be created if necessary)")
 	flag.Func("listen", "`SOCKET` to listen on, in go-listener syntax (repeatable)", func(arg string) error {
 		flags.listen = append(flags.listen, arg)
 		return nil
 	})
+	flag.Func("alert-webhook", "`URL` to POST a JSON alert to when the log misbehaves (repeatable)", func(arg string) error {
+		flags.alertWebhooks = append(flags.alertWebhooks, arg)
+		return nil
+	})
+	flag.Func("alert-exec", "`PATH` to a command to run with a JSON alert on stdin when the log misbehaves (repeatable)", func(arg string) error {
+		flags.alertExec = append(flags.alertExec, arg)
+		return nil
+	})
+	flag.Func("alert-file", "`PATH` to a file to append JSON alerts to when the log misbehaves (repeatable)", func(arg string) error {
+		flags.alertFiles = append(flags.alertFiles, arg)
+		return nil
+	})
+	flag.Func("witness", "verifier key (`NAME+KEYID+KEY`) of a witness which must cosign checkpoints (repeatable)", func(arg string) error {
+		flags.witnesses = append(flags.witnesses, arg)
+		return nil
+	})
+	flag.IntVar(&flags.witnessQuorum, "witness-quorum", 0, "number of witnesses which must cosign a checkpoint (default all of them)")
+	flag.DurationVar(&flags.witnessMaxAge, "witness-max-age", time.Hour, "maximum age of a witness cosignature")
 	flag.StringVar(&flags.userAgent, "user-agent", defaultUserAgent(), "User-Agent to send with HTTP requests")
 	flag.BoolVar(&flags.unsafeNoFsync, "unsafe-nofsync", false, "disable database fsync (unsafe; only appropriate during initial indexing)")
 	flag.BoolVar(&flags.noLeafIndex, "no-leaf-index", false, "disable leaf indexing (get-proof-by-hash endpoint won't work)")
+	flag.BoolVar(&flags.frontend, "frontend", false, "don't index the log; serve the state stored in the database by another instance (requires -db)")
+	flag.BoolVar(&flags.serveUnindexedSTH, "serve-unindexed-sth", false, "serve the latest checkpoint before it has been indexed (get-proof-by-hash only works for indexed leaves)")
+	flag.BoolVar(&flags.verifyEntries, "verify-entries", false, "verify entries returned by get-entries and get-entry-and-proof against the log's Merkle tree")
+	flag.BoolVar(&flags.verifySCTs, "verify-scts", false, "verify SCTs returned by add-chain and add-pre-chain, returning a 502 error if invalid (requires -key)")
+	flag.BoolVar(&flags.mirror, "mirror", false, "store every tile and issuer in the database and serve without contacting the log (requires -db)")
+	flag.BoolVar(&flags.certIndex, "cert-index", false, "index entries by certificate SHA-256 for the lookup-by-cert-sha256 endpoint (requires -db)")
+	flag.BoolVar(&flags.dnsIndex, "dns-index", false, "index entries by DNS name for the search-dns-name endpoint (requires -db)")
+	flag.BoolVar(&flags.precertIndex, "precert-index", false, "index precertificate entries for the lookup-precert-by-cert endpoint (requires -db)")
+	flag.BoolVar(&flags.localProofs, "local-proofs", false, "compute proofs from tiles stored in the database instead of downloading them from the log (requires -db)")
+	flag.DurationVar(&flags.pollInterval, "poll-interval", time.Minute, "how often to download the log's checkpoint")
+	flag.IntVar(&flags.indexWorkers, "index-workers", 500, "number of leaf tiles to download concurrently when indexing")
+	flag.IntVar(&flags.tileCacheSize, "tile-cache-size", 1024, "number of full tiles to cache in memory when -db is not specified")
+	flag.IntVar(&flags.getEntriesTiles, "get-entries-tiles", 1, "maximum number of data tiles to download for a get-entries request")
+	flag.IntVar(&flags.maxGetEntries, "max-get-entries", 0, "maximum number of entries to return from get-entries (default 256 times -get-entries-tiles)")
+	flag.Uint64Var(&flags.readyMaxLag, "ready-max-lag", 65536, "maximum number of unindexed entries for /readyz to report ready")
+	flag.DurationVar(&flags.mmd, "mmd", 24*time.Hour, "log's maximum merge delay, after which SCTs for submissions made through this proxy must be incorporated")
+	flag.DurationVar(&flags.readyMaxStale, "ready-max-staleness", 0, "maximum time since the log was last contacted for /readyz to report ready (default 10 times -poll-interval)")
 	flag.Parse()
 
-	if flags.id == (proxy.LogID{}) {
-		log.Fatal("-id flag required")
+	if configPath != "" {
+		explicit := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+		if err := loadConfigFile(configPath, &flags, explicit); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	multiLog := len(flags.logs) > 0
+	logs := flags.logs
+	if !multiLog {
+		if err := flags.single.validate(); err != nil {
+			log.Fatalf("missing configuration: %s", err)
+		}
+		log.SetPrefix(flags.single.monitoring.String() + " ")
+		logs = []*logSpec{&flags.single}
+	} else if flags.single.id != (proxy.LogID{}) || flags.single.key != nil || flags.single.submission != nil || flags.single.monitoring != nil || flags.single.checkpoint != nil || flags.single.origin != "" || flags.single.db != "" {
+		log.Fatal("-id, -key, -submission, -monitoring, -checkpoint, -origin, and -db cannot be used with -log")
+	}
+	patterns := make(map[string]*logSpec)
+	for _, spec := range logs {
+		if other, ok := patterns[spec.pattern()]; ok {
+			log.Fatalf("logs %s and %s are both served at %s; each log needs a different host or path", other.monitoring, spec.monitoring, spec.pattern())
+		}
+		patterns[spec.pattern()] = spec
+	}
+	if flags.pollInterval <= 0 {
+		log.Fatal("-poll-interval must be positive")
+	}
+	if flags.indexWorkers <= 0 {
+		log.Fatal("-index-workers must be positive")
 	}
-	if flags.submission == nil {
-		log.Fatal("-submission flag required")
+	if flags.tileCacheSize <= 0 {
+		log.Fatal("-tile-cache-size must be positive")
 	}
-	if flags.monitoring == nil {
-		log.Fatal("-monitoring flag required")
+	if flags.getEntriesTiles <= 0 {
+		log.Fatal("-get-entries-tiles must be positive")
+	}
+	if flags.maxGetEntries < 0 {
+		log.Fatal("-max-get-entries must not be negative")
+	}
+	if flags.readyMaxStale < 0 {
+		log.Fatal("-ready-max-staleness must not be negative")
+	}
+	if flags.mmd <= 0 {
+		log.Fatal("-mmd must be positive")
+	}
+	if flags.witnessQuorum < 0 {
+		log.Fatal("-witness-quorum must not be negative")
+	}
+	if flags.witnessMaxAge <= 0 {
+		log.Fatal("-witness-max-age must be positive")
 	}
 
-	log.SetPrefix(flags.monitoring.String() + " ")
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 100
+	httpClient := &http.Client{Transport: transport}
 
-	server, err := proxy.NewServer(&proxy.Config{
-		LogID:            flags.id,
-		DBPath:           flags.db,
-		SubmissionPrefix: flags.submission,
-		MonitoringPrefix: flags.monitoring,
-		UserAgent:        flags.userAgent,
-		UnsafeNoFsync:    flags.unsafeNoFsync,
-		DisableLeafIndex: flags.noLeafIndex,
-	})
-	if err != nil {
-		log.Fatal(err)
+	var alertSinks []proxy.AlertSink
+	for _, webhookURL := range flags.alertWebhooks {
+		alertSinks = append(alertSinks, &proxy.WebhookAlertSink{URL: webhookURL, Client: httpClient})
+	}
+	for _, command := range flags.alertExec {
+		alertSinks = append(alertSinks, &proxy.ExecAlertSink{Command: command})
+	}
+	for _, path := range flags.alertFiles {
+		alertSinks = append(alertSinks, &proxy.FileAlertSink{Path: path})
+	}
+
+	// with -issuer-db, all logs share issuerStore; otherwise, each log caches
+	// issuers in its own database, and logs without one share issuerStore
+	var issuerStore *proxy.IssuerStore
+	if flags.issuerDB != "" {
+		if store, err := proxy.OpenIssuerStore(flags.issuerDB); err != nil {
+			log.Fatal(err)
+		} else {
+			issuerStore = store
+		}
+		defer issuerStore.Close()
+	} else if multiLog {
+		issuerStore = proxy.NewIssuerStore()
+	}
+
+	mux := http.NewServeMux()
+	servers := make([]*proxy.Server, len(logs))
+	for i, spec := range logs {
+		var logger *log.Logger
+		if multiLog {
+			logger = log.New(log.Writer(), spec.monitoring.String()+" ", log.Flags())
+		}
+		logIssuerStore := issuerStore
+		if flags.issuerDB == "" && spec.db != "" {
+			logIssuerStore = nil // use the log's database
+		}
+		server, err := proxy.NewServer(&proxy.Config{
+			LogID:             spec.id,
+			LogPublicKey:      spec.key,
+			DBPath:            spec.db,
+			SubmissionPrefix:  spec.submission,
+			MonitoringPrefix:  spec.monitoring,
+			CheckpointURL:     spec.checkpoint,
+			Origin:            spec.origin,
+			UserAgent:         flags.userAgent,
+			UnsafeNoFsync:     flags.unsafeNoFsync,
+			DisableLeafIndex:  flags.noLeafIndex,
+			Frontend:          flags.frontend,
+			ServeUnindexedSTH: flags.serveUnindexedSTH,
+			VerifyEntries:     flags.verifyEntries,
+			VerifySCTs:        flags.verifySCTs,
+			Mirror:            flags.mirror,
+			CertIndex:         flags.certIndex,
+			DNSIndex:          flags.dnsIndex,
+			PrecertIndex:      flags.precertIndex,
+			LocalProofs:       flags.localProofs,
+			AlertSinks:        alertSinks,
+			PollInterval:      flags.pollInterval,
+			IndexWorkers:      flags.indexWorkers,
+			TileCacheSize:     flags.tileCacheSize,
+			GetEntriesTiles:   flags.getEntriesTiles,
+			MaxGetEntries:     flags.maxGetEntries,
+			ReadyMaxLag:       flags.readyMaxLag,
+			ReadyMaxStaleness: flags.readyMaxStale,
+			MMD:               flags.mmd,
+			Witnesses:         flags.witnesses,
+			WitnessQuorum:     flags.witnessQuorum,
+			WitnessMaxAge:     flags.witnessMaxAge,
+			HTTPClient:        httpClient,
+			IssuerStore:       logIssuerStore,
+			Logger:            logger,
+		})
+		if err != nil {
+			log.Fatalf("%s: %s", spec.monitoring, err)
+		}
+		mux.Handle(spec.pattern(), http.StripPrefix(spec.path, server))
+		servers[i] = server
+	}
+	if multiLog {
+		mux.Handle("GET /metrics", proxy.MetricsHandler(servers))
+		mux.Handle("GET /healthz", proxy.HealthzHandler(servers))
+		mux.Handle("GET /readyz", proxy.ReadyzHandler(servers))
 	}
 
 	httpServer := http.Server{
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 30 * time.Second,
 		IdleTimeout:  30 * time.Second,
-		Handler:      http.MaxBytesHandler(server, 128*1024),
+		Handler:      http.MaxBytesHandler(mux, 128*1024),
 	}
 
 	listeners, err := listener.OpenAll(flags.listen)
@@ -110,11 +397,37 @@ func main() {
 	}
 	defer listener.CloseAll(listeners)
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	group, ctx := errgroup.WithContext(ctx)
 	for _, l := range listeners {
-		go func(l net.Listener) {
-			log.Fatal(httpServer.Serve(l))
-		}(l)
+		group.Go(func() error {
+			if err := httpServer.Serve(l); err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		})
+	}
+	for _, server := range servers {
+		group.Go(func() error {
+			return server.Run(ctx)
+		})
+	}
+	group.Go(func() error {
+		<-ctx.Done()
+		log.Print("shutting down...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return httpServer.Shutdown(shutdownCtx)
+	})
+	err = group.Wait()
+	for _, server := range servers {
+		if err := server.Close(); err != nil {
+			log.Printf("error closing database: %s", err)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	log.Fatal(server.Run())
 }
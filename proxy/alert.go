@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Alert describes evidence that a log has misbehaved
+type Alert struct {
+	Type               string    `json:"type"` // see README for the possible types
+	Log                string    `json:"log"`  // monitoring prefix
+	Time               time.Time `json:"time"`
+	Message            string    `json:"message"`
+	Checkpoint         string    `json:"checkpoint,omitempty"`          // the offending checkpoint
+	PreviousCheckpoint string    `json:"previous_checkpoint,omitempty"` // the previously-accepted checkpoint, if relevant
+}
+
+type AlertSink interface {
+	SendAlert(context.Context, *Alert) error
+}
+
+// WebhookAlertSink POSTs alerts as JSON to a URL
+type WebhookAlertSink struct {
+	URL    string
+	Client *http.Client // defaults to http.DefaultClient
+}
+
+func (sink *WebhookAlertSink) SendAlert(ctx context.Context, alert *Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sink.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := sink.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s returned %s", sink.URL, resp.Status)
+	}
+	return nil
+}
+
+// ExecAlertSink runs a command for each alert, with the alert as JSON on
+// stdin and its type and message in the environment variables
+// SUNGLASSES_ALERT_TYPE and SUNGLASSES_ALERT_MESSAGE
+type ExecAlertSink struct {
+	Command string
+	Args    []string
+}
+
+func (sink *ExecAlertSink) SendAlert(ctx context.Context, alert *Alert) error {
+	input, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, sink.Command, sink.Args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = append(os.Environ(),
+		"SUNGLASSES_ALERT_TYPE="+alert.Type,
+		"SUNGLASSES_ALERT_MESSAGE="+alert.Message,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", sink.Command, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// FileAlertSink appends alerts to a file as JSON, one per line
+type FileAlertSink struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (sink *FileAlertSink) SendAlert(ctx context.Context, alert *Alert) error {
+	line, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	file, err := os.OpenFile(sink.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// alertRepeatInterval is how long a repeat of an alert is suppressed, so
+// that persistent misbehavior doesn't raise the same alert on every poll
+const alertRepeatInterval = 24 * time.Hour
+
+// alertKey identifies repeats of an alert
+func alertKey(alert *Alert) string {
+	if alert.Checkpoint != "" {
+		return alert.Type + "\x00" + alert.Checkpoint
+	}
+	return alert.Type + "\x00" + alert.Message
+}
+
+// isRepeatAlert reports whether an alert with the same key was raised within
+// alertRepeatInterval, and if not, records this one
+func (srv *Server) isRepeatAlert(alert *Alert) bool {
+	srv.recentAlertsMu.Lock()
+	defer srv.recentAlertsMu.Unlock()
+	for key, raised := range srv.recentAlerts {
+		if alert.Time.Sub(raised) >= alertRepeatInterval {
+			delete(srv.recentAlerts, key)
+		}
+	}
+	key := alertKey(alert)
+	if _, ok := srv.recentAlerts[key]; ok {
+		return true
+	}
+	srv.recentAlerts[key] = alert.Time
+	return false
+}
+
+// raiseAlert logs the alert and sends it to every alert sink in the
+// background, unless it's a repeat of a recent alert
+func (srv *Server) raiseAlert(ctx context.Context, alert *Alert) {
+	alert.Log = srv.monitoringPrefix.String()
+	alert.Time = time.Now()
+	if srv.isRepeatAlert(alert) {
+		return
+	}
+	srv.metrics.alerts.inc(labels{"type", alert.Type})
+	srv.log.Printf("ALERT (%s): %s", alert.Type, alert.Message)
+
+	srv.pendingAlerts.Add(1)
+	go func() {
+		defer srv.pendingAlerts.Done()
+		// alerts are too important to drop during shutdown, so Run waits for them
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		for _, sink := range srv.alertSinks {
+			if err := sink.SendAlert(ctx, alert); err != nil {
+				srv.log.Printf("error sending alert: %s", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Witness cosignatures, as specified by C2SP tlog-cosignature
+
+const cosignatureV1Algorithm = 0x04
+
+type witness struct {
+	name  string
+	keyID [4]byte
+	key   ed25519.PublicKey
+}
+
+// parseWitness parses a witness verifier key of the form NAME+KEYID+KEY
+func parseWitness(vkey string) (*witness, error) {
+	name, rest, _ := strings.Cut(vkey, "+")
+	keyIDHex, keyBase64, ok := strings.Cut(rest, "+")
+	if !ok || name == "" {
+		return nil, errors.New("verifier key is not of the form NAME+KEYID+KEY")
+	}
+	keyBytes, err := base64.StdEncoding.DecodeString(keyBase64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed key: %w", err)
+	}
+	if len(keyBytes) != 1+ed25519.PublicKeySize || keyBytes[0] != cosignatureV1Algorithm {
+		return nil, errors.New("key is not a cosignature/v1 Ed25519 key")
+	}
+	w := &witness{name: name, key: ed25519.PublicKey(keyBytes[1:])}
+	w.keyID = makeWitnessKeyID(name, keyBytes)
+	if keyID, err := hex.DecodeString(keyIDHex); err != nil || !bytes.Equal(keyID, w.keyID[:]) {
+		return nil, fmt.Errorf("key ID %q does not match the key", keyIDHex)
+	}
+	return w, nil
+}
+
+func makeWitnessKeyID(name string, keyBytes []byte) [4]byte {
+	h := sha256.New()
+	h.Write([]byte(name))
+	h.Write([]byte{'\n'})
+	h.Write(keyBytes)
+
+	var digest [sha256.Size]byte
+	h.Sum(digest[:0])
+	return [4]byte(digest[:4])
+}
+
+// verifyCosignature verifies the witness's cosignature over the note text,
+// returning the cosignature's timestamp
+func (w *witness) verifyCosignature(text []byte, signatureBytes []byte) (time.Time, error) {
+	if len(signatureBytes) != 4+8+ed25519.SignatureSize {
+		return time.Time{}, errors.New("cosignature has wrong length")
+	}
+	timestamp := binary.BigEndian.Uint64(signatureBytes[4:12])
+	message := "cosignature/v1\ntime " + strconv.FormatUint(timestamp, 10) + "\n" + string(text)
+	if !ed25519.Verify(w.key, []byte(message), signatureBytes[12:]) {
+		return time.Time{}, errors.New("cosignature is incorrect")
+	}
+	return time.Unix(int64(timestamp), 0), nil
+}
+
+// checkCosignatures checks that the checkpoint which sth was parsed from
+// carries valid cosignatures from at least witnessQuorum witnesses, made no
+// earlier than the checkpoint's timestamp and no longer than witnessMaxAge ago
+func (srv *Server) checkCosignatures(sth *signedTreeHead) error {
+	textLen := bytes.Index(sth.checkpoint, []byte("\n\n"))
+	if textLen == -1 {
+		return errors.New("checkpoint is not a signed note")
+	}
+	text, signatures := sth.checkpoint[:textLen+1], sth.checkpoint[textLen+2:]
+	oldest := time.Now().Add(-srv.witnessMaxAge)
+	sthTime := time.UnixMilli(int64(sth.Timestamp)).Truncate(time.Second)
+
+	cosigned := make(map[*witness]bool)
+	var problems []string
+	for {
+		signatureLine, rest, ok := chompCheckpointLine(signatures)
+		if !ok {
+			break
+		}
+		signatures = rest
+		signatureLine, ok = strings.CutPrefix(signatureLine, "\u2014 ")
+		if !ok {
+			continue
+		}
+		name, signatureBase64, ok := strings.Cut(signatureLine, " ")
+		if !ok {
+			continue
+		}
+		signatureBytes, err := base64.StdEncoding.DecodeString(signatureBase64)
+		if err != nil || len(signatureBytes) < 4 {
+			continue
+		}
+		for _, w := range srv.witnesses {
+			if w.name != name || !bytes.Equal(w.keyID[:], signatureBytes[:4]) {
+				continue
+			}
+			if timestamp, err := w.verifyCosignature(text, signatureBytes); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", w.name, err))
+			} else if timestamp.Before(sthTime) {
+				problems = append(problems, fmt.Sprintf("%s: cosignature time %s is before checkpoint time %s", w.name, timestamp, sthTime))
+			} else if timestamp.Before(oldest) {
+				problems = append(problems, fmt.Sprintf("%s: cosignature time %s is too old", w.name, timestamp))
+			} else {
+				cosigned[w] = true
+			}
+		}
+	}
+	if len(cosigned) < srv.witnessQuorum {
+		err := fmt.Sprintf("checkpoint has %d timely cosignatures from configured witnesses, but %d are required", len(cosigned), srv.witnessQuorum)
+		if len(problems) > 0 {
+			err += " (" + strings.Join(problems, "; ") + ")"
+		}
+		return errors.New(err)
+	}
+	return nil
+}
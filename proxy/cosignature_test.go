@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A cosignature/v1 test vector, generated from the Ed25519 seed 0x01..0x20
+// following the key hash and message format of transparency-dev/formats
+const (
+	vectorWitnessKey  = "witness.example.com+7e62d793+BHm1Vi6P5lT5QHixEuipi6eQH4U65pW+1+DjkQutBJZk"
+	vectorText        = "example.com/log\n1000\nSBNJTRN+FjG7owHVrKtue7eqdM4RhdRWVl71HXN2d7I=\n"
+	vectorCosignature = "— witness.example.com fmLXkwAAAABlU/FkFbVSkC3MH+2a9ifE+4JEn+7e59Xr+iql2WqjdkRcoiyCNMNvZu2j7TtQ9tkT0BNnJ1dZTZQQn/la10Z3quV/Dw==\n"
+	vectorTimestamp   = 1700000100
+)
+
+// testWitness produces cosignatures, encoded independently of the code under test
+type testWitness struct {
+	name string
+	key  ed25519.PrivateKey
+}
+
+func newTestWitness(t *testing.T, name string) *testWitness {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testWitness{name: name, key: key}
+}
+
+func (w *testWitness) keyBytes() []byte {
+	return append([]byte{0x04}, w.key.Public().(ed25519.PublicKey)...)
+}
+
+func (w *testWitness) keyID() []byte {
+	digest := sha256.Sum256(append([]byte(w.name+"\n"), w.keyBytes()...))
+	return digest[:4]
+}
+
+func (w *testWitness) verifierKey() string {
+	return fmt.Sprintf("%s+%x+%s", w.name, w.keyID(), base64.StdEncoding.EncodeToString(w.keyBytes()))
+}
+
+// cosign returns a signature line cosigning the note text at the given time
+func (w *testWitness) cosign(text string, timestamp time.Time) string {
+	message := fmt.Sprintf("cosignature/v1\ntime %d\n%s", timestamp.Unix(), text)
+	signature := append(w.keyID(), binary.BigEndian.AppendUint64(nil, uint64(timestamp.Unix()))...)
+	signature = append(signature, ed25519.Sign(w.key, []byte(message))...)
+	return "— " + w.name + " " + base64.StdEncoding.EncodeToString(signature) + "\n"
+}
+
+func TestParseWitness(t *testing.T) {
+	w, err := parseWitness(vectorWitnessKey)
+	if err != nil {
+		t.Fatalf("error parsing test vector key: %s", err)
+	}
+	if w.name != "witness.example.com" {
+		t.Errorf("name is %q", w.name)
+	}
+	if w.keyID != [4]byte{0x7e, 0x62, 0xd7, 0x93} {
+		t.Errorf("key ID is %x", w.keyID)
+	}
+	seed := make([]byte, ed25519.SeedSize)
+	for i := range seed {
+		seed[i] = byte(i + 1)
+	}
+	if !w.key.Equal(ed25519.NewKeyFromSeed(seed).Public()) {
+		t.Errorf("key is %x", []byte(w.key))
+	}
+
+	random := newTestWitness(t, "random.example")
+	if w, err := parseWitness(random.verifierKey()); err != nil {
+		t.Errorf("error parsing key: %s", err)
+	} else if string(w.keyID[:]) != string(random.keyID()) {
+		t.Errorf("key ID is %x, expected %x", w.keyID, random.keyID())
+	}
+
+	// a key for ordinary Ed25519 note signatures, with the key ID derived the same way
+	noteKey := append([]byte{0x01}, random.key.Public().(ed25519.PublicKey)...)
+	noteKeyID := sha256.Sum256(append([]byte(random.name+"\n"), noteKey...))
+	keyBase64 := base64.StdEncoding.EncodeToString(random.keyBytes())
+	for name, vkey := range map[string]string{
+		"wrong key ID":     fmt.Sprintf("%s+%x+%s", random.name, noteKeyID[:4], keyBase64),
+		"other name":       fmt.Sprintf("other.example+%x+%s", random.keyID(), keyBase64),
+		"malformed key ID": fmt.Sprintf("%s+xyz+%s", random.name, keyBase64),
+		"Ed25519 note key": fmt.Sprintf("%s+%x+%s", random.name, noteKeyID[:4], base64.StdEncoding.EncodeToString(noteKey)),
+		"truncated key":    fmt.Sprintf("%s+%x+%s", random.name, random.keyID(), base64.StdEncoding.EncodeToString(random.keyBytes()[:32])),
+		"malformed base64": fmt.Sprintf("%s+%x+%s", random.name, random.keyID(), keyBase64[1:]),
+		"missing name":     fmt.Sprintf("+%x+%s", random.keyID(), keyBase64),
+		"missing key":      fmt.Sprintf("%s+%x", random.name, random.keyID()),
+		"empty":            "",
+	} {
+		if _, err := parseWitness(vkey); err == nil {
+			t.Errorf("%s: parseWitness succeeded", name)
+		}
+	}
+}
+
+func TestVerifyCosignatureVector(t *testing.T) {
+	w, err := parseWitness(vectorWitnessKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signatureBase64 := strings.TrimSuffix(vectorCosignature[strings.LastIndexByte(vectorCosignature, ' ')+1:], "\n")
+	signature, err := base64.StdEncoding.DecodeString(signatureBase64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestamp, err := w.verifyCosignature([]byte(vectorText), signature); err != nil {
+		t.Errorf("error verifying test vector: %s", err)
+	} else if !timestamp.Equal(time.Unix(vectorTimestamp, 0)) {
+		t.Errorf("timestamp is %s", timestamp)
+	}
+	if _, err := w.verifyCosignature([]byte(strings.Replace(vectorText, "1000", "1001", 1)), signature); err == nil {
+		t.Error("cosignature verified over a different tree size")
+	}
+	retimed := append([]byte(nil), signature...)
+	retimed[11]++
+	if _, err := w.verifyCosignature([]byte(vectorText), retimed); err == nil {
+		t.Error("cosignature verified with a different timestamp")
+	}
+	if _, err := w.verifyCosignature([]byte(vectorText), signature[:len(signature)-1]); err == nil {
+		t.Error("truncated cosignature verified")
+	}
+
+	// the log's own signature precedes the cosignature and is ignored
+	srv := &Server{witnesses: []*witness{w}, witnessQuorum: 1, witnessMaxAge: time.Since(time.Unix(vectorTimestamp, 0)) + time.Hour}
+	checkpoint := vectorText + "\n— example.com/log AAAAAQIDBAU=\n" + vectorCosignature
+	sth := &signedTreeHead{TreeSize: 1000, Timestamp: 1700000000000, checkpoint: []byte(checkpoint)}
+	if err := srv.checkCosignatures(sth); err != nil {
+		t.Errorf("error checking cosignatures of test vector: %s", err)
+	}
+	sth.Timestamp = (vectorTimestamp + 1) * 1000
+	if err := srv.checkCosignatures(sth); err == nil {
+		t.Error("cosignature made before the checkpoint was accepted")
+	}
+}
+
+func TestCheckCosignatures(t *testing.T) {
+	witnesses := []*testWitness{newTestWitness(t, "a.example"), newTestWitness(t, "b.example"), newTestWitness(t, "c.example")}
+	outsider := newTestWitness(t, "d.example")
+	impostor := newTestWitness(t, "a.example")
+
+	srv := &Server{witnessMaxAge: time.Hour}
+	for _, tw := range witnesses {
+		w, err := parseWitness(tw.verifierKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.witnesses = append(srv.witnesses, w)
+	}
+
+	sthTime := time.Now().Add(-10 * time.Minute).Truncate(time.Millisecond)
+	text := "example.com/log\n1000\nSBNJTRN+FjG7owHVrKtue7eqdM4RhdRWVl71HXN2d7I=\n"
+	otherText := "example.com/log\n1001\nSBNJTRN+FjG7owHVrKtue7eqdM4RhdRWVl71HXN2d7I=\n"
+	now := time.Now()
+	stale := now.Add(-2 * time.Hour)
+	early := sthTime.Truncate(time.Second).Add(-time.Second)
+
+	tests := []struct {
+		name       string
+		quorum     int
+		signatures []string
+		valid      bool
+		problem    string
+	}{
+		{"all", 3, []string{witnesses[0].cosign(text, now), witnesses[1].cosign(text, now), witnesses[2].cosign(text, now)}, true, ""},
+		{"quorum", 2, []string{witnesses[0].cosign(text, now), witnesses[2].cosign(text, now)}, true, ""},
+		{"below quorum", 3, []string{witnesses[0].cosign(text, now), witnesses[2].cosign(text, now)}, false, ""},
+		{"no cosignatures", 1, nil, false, ""},
+		{"no quorum", 0, nil, true, ""},
+		{"at checkpoint time", 1, []string{witnesses[0].cosign(text, sthTime)}, true, ""},
+		{"stale", 2, []string{witnesses[0].cosign(text, now), witnesses[1].cosign(text, stale)}, false, "b.example: cosignature time"},
+		{"stale beyond quorum", 1, []string{witnesses[0].cosign(text, now), witnesses[1].cosign(text, stale)}, true, ""},
+		{"early", 2, []string{witnesses[0].cosign(text, now), witnesses[1].cosign(text, early)}, false, "is before checkpoint time"},
+		{"duplicate", 2, []string{witnesses[0].cosign(text, now), witnesses[0].cosign(text, now.Add(-time.Second))}, false, ""},
+		{"duplicate with stale", 1, []string{witnesses[0].cosign(text, stale), witnesses[0].cosign(text, now)}, true, ""},
+		{"unconfigured witness", 2, []string{witnesses[0].cosign(text, now), outsider.cosign(text, now)}, false, ""},
+		{"impostor", 2, []string{witnesses[0].cosign(text, now), impostor.cosign(text, now)}, false, ""},
+		{"other checkpoint", 2, []string{witnesses[0].cosign(text, now), witnesses[1].cosign(otherText, now)}, false, "b.example: cosignature is incorrect"},
+		{"not a signature line", 1, []string{"- a.example " + strings.TrimPrefix(witnesses[0].cosign(text, now), "— a.example ")}, false, ""},
+	}
+	for _, test := range tests {
+		srv.witnessQuorum = test.quorum
+		sth := &signedTreeHead{
+			TreeSize:   1000,
+			Timestamp:  uint64(sthTime.UnixMilli()),
+			checkpoint: []byte(text + "\n" + strings.Join(test.signatures, "")),
+		}
+		err := srv.checkCosignatures(sth)
+		if test.valid && err != nil {
+			t.Errorf("%s: checkCosignatures failed: %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: checkCosignatures succeeded", test.name)
+		} else if err != nil && !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("%s: error doesn't mention %q: %s", test.name, test.problem, err)
+		}
+	}
+
+	if err := srv.checkCosignatures(&signedTreeHead{checkpoint: []byte(text)}); err == nil {
+		t.Error("checkCosignatures accepted a checkpoint without signatures")
+	}
+}
+
+func TestWitnessConfig(t *testing.T) {
+	a, b := newTestWitness(t, "a.example"), newTestWitness(t, "b.example")
+	prefix := &url.URL{Scheme: "https", Host: "example.com", Path: "/log/"}
+	tests := []struct {
+		name      string
+		witnesses []string
+		quorum    int
+		valid     bool
+		effective int
+	}{
+		{"default quorum", []string{a.verifierKey(), b.verifierKey()}, 0, true, 2},
+		{"quorum", []string{a.verifierKey(), b.verifierKey()}, 1, true, 1},
+		{"quorum too large", []string{a.verifierKey(), b.verifierKey()}, 3, false, 0},
+		{"duplicate", []string{a.verifierKey(), b.verifierKey(), a.verifierKey()}, 2, false, 0},
+		{"malformed", []string{a.verifierKey(), "a.example"}, 1, false, 0},
+	}
+	for _, test := range tests {
+		srv, err := NewServer(&Config{
+			LogID:            LogID{1},
+			SubmissionPrefix: prefix,
+			MonitoringPrefix: prefix,
+			Witnesses:        test.witnesses,
+			WitnessQuorum:    test.quorum,
+		})
+		if test.valid && err != nil {
+			t.Errorf("%s: NewServer failed: %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: NewServer succeeded", test.name)
+		} else if err == nil && srv.witnessQuorum != test.effective {
+			t.Errorf("%s: witness quorum is %d", test.name, srv.witnessQuorum)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"encoding/asn1"
+	"errors"
+	"golang.org/x/crypto/cryptobyte"
+	cryptobyte_asn1 "golang.org/x/crypto/cryptobyte/asn1"
+	"slices"
+	"strings"
+	"unicode/utf16"
+)
+
+var (
+	oidCommonName     = asn1.ObjectIdentifier{2, 5, 4, 3}
+	oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+)
+
+// parseDNSNames returns the normalized DNS names in the given certificate's
+// subjectAltName extension and subject common names.  Parsing is lenient,
+// since logs contain many certificates that are malformed in minor ways.
+func parseDNSNames(certDER []byte) ([]string, error) {
+	var cert, tbs cryptobyte.String
+	input := cryptobyte.String(certDER)
+	if !input.ReadASN1(&cert, cryptobyte_asn1.SEQUENCE) || !cert.ReadASN1(&tbs, cryptobyte_asn1.SEQUENCE) {
+		return nil, errors.New("malformed certificate")
+	}
+	if !tbs.SkipOptionalASN1(cryptobyte_asn1.Tag(0).Constructed().ContextSpecific()) ||
+		!tbs.SkipASN1(cryptobyte_asn1.INTEGER) ||
+		!tbs.SkipASN1(cryptobyte_asn1.SEQUENCE) ||
+		!tbs.SkipASN1(cryptobyte_asn1.SEQUENCE) ||
+		!tbs.SkipASN1(cryptobyte_asn1.SEQUENCE) {
+		return nil, errors.New("malformed TBSCertificate")
+	}
+	var subject cryptobyte.String
+	if !tbs.ReadASN1(&subject, cryptobyte_asn1.SEQUENCE) ||
+		!tbs.SkipASN1(cryptobyte_asn1.SEQUENCE) ||
+		!tbs.SkipOptionalASN1(cryptobyte_asn1.Tag(1).ContextSpecific()) ||
+		!tbs.SkipOptionalASN1(cryptobyte_asn1.Tag(2).ContextSpecific()) {
+		return nil, errors.New("malformed TBSCertificate")
+	}
+
+	var names []string
+	for !subject.Empty() {
+		var rdn cryptobyte.String
+		if !subject.ReadASN1(&rdn, cryptobyte_asn1.SET) {
+			return nil, errors.New("malformed subject")
+		}
+		for !rdn.Empty() {
+			var atv cryptobyte.String
+			var oid asn1.ObjectIdentifier
+			var valueTag cryptobyte_asn1.Tag
+			var value cryptobyte.String
+			if !rdn.ReadASN1(&atv, cryptobyte_asn1.SEQUENCE) || !atv.ReadASN1ObjectIdentifier(&oid) || !atv.ReadAnyASN1(&value, &valueTag) {
+				return nil, errors.New("malformed subject attribute")
+			}
+			if oid.Equal(oidCommonName) {
+				if name, ok := normalizeDNSName(decodeASN1String(valueTag, value)); ok {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+
+	var extensions cryptobyte.String
+	var hasExtensions bool
+	if !tbs.ReadOptionalASN1(&extensions, &hasExtensions, cryptobyte_asn1.Tag(3).Constructed().ContextSpecific()) {
+		return nil, errors.New("malformed extensions")
+	}
+	if hasExtensions && !extensions.ReadASN1(&extensions, cryptobyte_asn1.SEQUENCE) {
+		return nil, errors.New("malformed extensions")
+	}
+	for !extensions.Empty() {
+		var extension, value cryptobyte.String
+		var oid asn1.ObjectIdentifier
+		if !extensions.ReadASN1(&extension, cryptobyte_asn1.SEQUENCE) ||
+			!extension.ReadASN1ObjectIdentifier(&oid) ||
+			!extension.SkipOptionalASN1(cryptobyte_asn1.BOOLEAN) ||
+			!extension.ReadASN1(&value, cryptobyte_asn1.OCTET_STRING) {
+			return nil, errors.New("malformed extension")
+		}
+		if !oid.Equal(oidSubjectAltName) {
+			continue
+		}
+		var generalNames cryptobyte.String
+		if !value.ReadASN1(&generalNames, cryptobyte_asn1.SEQUENCE) {
+			return nil, errors.New("malformed subjectAltName extension")
+		}
+		for !generalNames.Empty() {
+			var generalName cryptobyte.String
+			var tag cryptobyte_asn1.Tag
+			if !generalNames.ReadAnyASN1(&generalName, &tag) {
+				return nil, errors.New("malformed subjectAltName extension")
+			}
+			if tag == cryptobyte_asn1.Tag(2).ContextSpecific() {
+				if name, ok := normalizeDNSName(string(generalName)); ok {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+
+	slices.Sort(names)
+	return slices.Compact(names), nil
+}
+
+func decodeASN1String(tag cryptobyte_asn1.Tag, value []byte) string {
+	if tag == cryptobyte_asn1.Tag(30) { // BMPString
+		if len(value)%2 != 0 {
+			return ""
+		}
+		codeUnits := make([]uint16, len(value)/2)
+		for i := range codeUnits {
+			codeUnits[i] = uint16(value[2*i])<<8 | uint16(value[2*i+1])
+		}
+		return string(utf16.Decode(codeUnits))
+	}
+	return string(value)
+}
+
+// normalizeDNSName lowercases name and removes any trailing dot, returning
+// false if name doesn't look like a DNS name (wildcards are allowed)
+func normalizeDNSName(name string) (string, bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name == "" || len(name) > 253 {
+		return "", false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return "", false
+		}
+		for _, c := range []byte(label) {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '*') {
+				return "", false
+			}
+		}
+	}
+	return name, true
+}
+
+// reverseDNSName reverses the labels of name (e.g. www.example.com becomes
+// com.example.www) so that all subdomains of a domain sort together
+func reverseDNSName(name string) string {
+	labels := strings.Split(name, ".")
+	slices.Reverse(labels)
+	return strings.Join(labels, ".")
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeDNSName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // empty if name should be rejected
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM", "example.com"},
+		{"example.com.", "example.com"},
+		{"WWW.Example.Com.", "www.example.com"},
+		{"*.example.com", "*.example.com"},
+		{"_acme-challenge.example.com", "_acme-challenge.example.com"},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example"},
+		{"XN--BCHER-KVA.example", "xn--bcher-kva.example"},
+		{"localhost", "localhost"},
+		{"bücher.example", ""}, // IDNs are only indexed in their A-label (punycode) form
+		{"", ""},
+		{".", ""},
+		{"example.com..", ""},
+		{".example.com", ""},
+		{"www..example.com", ""},
+		{"example .com", ""},
+		{"example.com/", ""},
+		{"192.0.2.1:443", ""},
+		{strings.Repeat("a.", 126) + "aa", ""}, // 254 characters
+		{strings.Repeat("a.", 126) + "a", strings.Repeat("a.", 126) + "a"},
+	}
+	for _, test := range tests {
+		got, ok := normalizeDNSName(test.name)
+		if test.want == "" {
+			if ok {
+				t.Errorf("normalizeDNSName(%q) accepted the name as %q", test.name, got)
+			}
+		} else if !ok || got != test.want {
+			t.Errorf("normalizeDNSName(%q) = %q, %v; want %q", test.name, got, ok, test.want)
+		}
+	}
+}
+
+func TestReverseDNSName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"www.example.com", "com.example.www"},
+		{"example.com", "com.example"},
+		{"com", "com"},
+		{"*.example.com", "com.example.*"},
+	}
+	for _, test := range tests {
+		if got := reverseDNSName(test.name); got != test.want {
+			t.Errorf("reverseDNSName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseDNSNames(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bmpString := func(s string) asn1.RawValue {
+		var value []byte
+		for _, c := range s {
+			value = append(value, byte(c>>8), byte(c))
+		}
+		return asn1.RawValue{Class: asn1.ClassUniversal, Tag: 30, Bytes: value}
+	}
+	tests := []struct {
+		name     string
+		template x509.Certificate
+		want     []string
+	}{
+		{
+			name:     "common name only",
+			template: x509.Certificate{Subject: pkix.Name{CommonName: "example.com"}},
+			want:     []string{"example.com"},
+		},
+		{
+			name:     "no names",
+			template: x509.Certificate{Subject: pkix.Name{Organization: []string{"Example"}}},
+			want:     nil,
+		},
+		{
+			name:     "common name which isn't a DNS name",
+			template: x509.Certificate{Subject: pkix.Name{CommonName: "Example Server"}, DNSNames: []string{"example.com"}},
+			want:     []string{"example.com"},
+		},
+		{
+			name:     "common name duplicated in subjectAltName",
+			template: x509.Certificate{Subject: pkix.Name{CommonName: "Example.com"}, DNSNames: []string{"example.com", "www.example.com", "WWW.example.com."}},
+			want:     []string{"example.com", "www.example.com"},
+		},
+		{
+			name:     "wildcards",
+			template: x509.Certificate{Subject: pkix.Name{CommonName: "*.example.com"}, DNSNames: []string{"*.example.com", "example.com"}},
+			want:     []string{"*.example.com", "example.com"},
+		},
+		{
+			name:     "trailing dots and upper case",
+			template: x509.Certificate{DNSNames: []string{"EXAMPLE.COM.", "Mail.Example.Org"}},
+			want:     []string{"example.com", "mail.example.org"},
+		},
+		{
+			name:     "punycode",
+			template: x509.Certificate{DNSNames: []string{"xn--bcher-kva.example", "www.XN--BCHER-KVA.example"}},
+			want:     []string{"www.xn--bcher-kva.example", "xn--bcher-kva.example"},
+		},
+		{
+			name:     "other kinds of names",
+			template: x509.Certificate{DNSNames: []string{"example.com"}, IPAddresses: []net.IP{net.IPv4(192, 0, 2, 1)}, EmailAddresses: []string{"admin@example.org"}},
+			want:     []string{"example.com"},
+		},
+		{
+			name:     "BMPString common name",
+			template: x509.Certificate{Subject: pkix.Name{ExtraNames: []pkix.AttributeTypeAndValue{{Type: oidCommonName, Value: bmpString("Example.NET")}}}},
+			want:     []string{"example.net"},
+		},
+	}
+	for _, test := range tests {
+		test.template.SerialNumber = big.NewInt(1)
+		test.template.NotBefore = time.Unix(1700000000, 0)
+		test.template.NotAfter = time.Unix(1710000000, 0)
+		der, err := x509.CreateCertificate(rand.Reader, &test.template, &test.template, key.Public(), key)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if got, err := parseDNSNames(der); err != nil {
+			t.Errorf("%s: parseDNSNames failed: %s", test.name, err)
+		} else if !slices.Equal(got, test.want) {
+			t.Errorf("%s: parseDNSNames returned %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	if _, err := parseDNSNames([]byte("garbage")); err == nil {
+		t.Error("parseDNSNames accepted a malformed certificate")
+	}
+}
+
+func TestSearchDNSName(t *testing.T) {
+	ctx := context.Background()
+	storage := openTestSQLStorage(t)
+	names := [][]string{
+		{"example.com"},
+		{"www.example.com"},
+		{"example.community"},
+		{"www.example.community"},
+		{"example.com.au"},
+		{"a.b.example.com", "*.example.com"},
+		{"notexample.com"},
+		{"com"},
+	}
+	if err := storage.PutDNSNames(ctx, 0, names); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Commit(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		subdomains bool
+		want       []uint64
+	}{
+		{"example.com", false, []uint64{0}},
+		{"example.com", true, []uint64{0, 1, 5}},
+		{"Example.COM.", true, []uint64{0, 1, 5}},
+		{"*.example.com", false, []uint64{5}},
+		{"example.community", true, []uint64{2, 3}},
+		{"www.example.com", true, []uint64{1}},
+		{"com", true, []uint64{0, 1, 5, 6, 7}},
+		{"community", true, []uint64{2, 3}},
+		{"example", true, []uint64{}},
+	}
+	for _, test := range tests {
+		name, ok := normalizeDNSName(test.name)
+		if !ok {
+			t.Fatalf("%q isn't a DNS name", test.name)
+		}
+		if got, err := storage.SearchDNSName(ctx, name, test.subdomains, 0, uint64(len(names)), 10); err != nil {
+			t.Fatal(err)
+		} else if !slices.Equal(got, test.want) {
+			t.Errorf("SearchDNSName(%q, %v) = %v, want %v", test.name, test.subdomains, got, test.want)
+		}
+	}
+}
@@ -4,10 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"golang.org/x/mod/sumdb/tlog"
 	"io"
 	mathrand "math/rand/v2"
 	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -27,7 +27,7 @@ func (e *downloadError) Unwrap() error {
 	return e.Err
 }
 
-func download(ctx context.Context, userAgent string, url string) ([]byte, error) {
+func (srv *Server) download(ctx context.Context, url string) ([]byte, error) {
 	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
 
@@ -35,11 +35,13 @@ func download(ctx context.Context, userAgent string, url string) ([]byte, error)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("User-Agent", userAgent)
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("User-Agent", srv.userAgent)
+	resp, err := srv.httpClient.Do(req)
 	if err != nil {
+		srv.metrics.downloads.inc(labels{"code", statusCodeLabel(0)})
 		return nil, &downloadError{Err: err}
 	}
+	srv.metrics.downloads.inc(labels{"code", statusCodeLabel(resp.StatusCode)})
 	body, err := io.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
@@ -55,7 +57,14 @@ func download(ctx context.Context, userAgent string, url string) ([]byte, error)
 	return body, nil
 }
 
-func downloadRetry(ctx context.Context, userAgent string, url string) ([]byte, error) {
+func (srv *Server) downloadRetry(ctx context.Context, url string) (_ []byte, err error) {
+	defer func() {
+		var derr *downloadError
+		if errors.As(err, &derr) {
+			srv.metrics.downloadFailures.inc(labels{"code", statusCodeLabel(derr.StatusCode)})
+		}
+	}()
+
 	const (
 		baseRetryDelay = 1 * time.Second
 		maxRetryDelay  = 10 * time.Second
@@ -65,7 +74,7 @@ func downloadRetry(ctx context.Context, userAgent string, url string) ([]byte, e
 	numRetries := 0
 	for {
 		var derr *downloadError
-		if resp, err := download(ctx, userAgent, url); err == nil {
+		if resp, err := srv.download(ctx, url); err == nil {
 			return resp, nil
 		} else if !errors.As(err, &derr) {
 			return nil, err
@@ -88,21 +97,38 @@ func downloadRetry(ctx context.Context, userAgent string, url string) ([]byte, e
 		if !sleep(ctx, delay) {
 			return nil, fmt.Errorf("%w (retried %d times)", derr, numRetries)
 		}
+		srv.metrics.downloadRetries.inc(labels{"code", statusCodeLabel(derr.StatusCode)})
 		numRetries++
 	}
 }
 
-func downloadTile(ctx context.Context, userAgent string, sth *signedTreeHead, prefix *url.URL, level string, tile uint64) ([]byte, error) {
+func (srv *Server) downloadTile(ctx context.Context, sth *signedTreeHead, level string, tile uint64) ([]byte, error) {
 	if partial := sth.TreeSize - tile*entriesPerTile; partial < entriesPerTile {
-		if data, err1 := downloadRetry(ctx, userAgent, prefix.JoinPath(formatTilePath(level, tile, partial)).String()); err1 == nil {
+		if data, err1 := srv.downloadRetry(ctx, srv.monitoringPrefix.JoinPath(formatTilePath(level, tile, partial)).String()); err1 == nil {
 			return data, nil
-		} else if data, err2 := downloadRetry(ctx, userAgent, prefix.JoinPath(formatTilePath(level, tile, entriesPerTile)).String()); err2 == nil {
+		} else if data, err2 := srv.downloadRetry(ctx, srv.monitoringPrefix.JoinPath(formatTilePath(level, tile, entriesPerTile)).String()); err2 == nil {
 			return data, nil
 		} else {
 			return nil, err1
 		}
 	}
-	return downloadRetry(ctx, userAgent, prefix.JoinPath(formatTilePath(level, tile, entriesPerTile)).String())
+	return srv.downloadRetry(ctx, srv.monitoringPrefix.JoinPath(formatTilePath(level, tile, entriesPerTile)).String())
+}
+
+// fetchTile returns the given tile (level -1 for data tiles) of sth's tree,
+// from local storage in mirror mode or else from the log
+func (srv *Server) fetchTile(ctx context.Context, sth *signedTreeHead, level int, n uint64) ([]byte, error) {
+	if !srv.mirror {
+		return srv.downloadTile(ctx, sth, tileLevelName(level), n)
+	}
+	tile := tlog.Tile{H: tileHeight, L: level, N: int64(n), W: int(min(entriesPerTile, sth.TreeSize-n*entriesPerTile))}
+	if data, ok, err := srv.loadTile(ctx, tile); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("tile %s has not been mirrored", tile.Path())
+	} else {
+		return data, nil
+	}
 }
 
 func formatTilePath(level string, tile uint64, width uint64) string {
@@ -3,10 +3,11 @@ package proxy
 import (
 	"context"
 	"crypto/sha256"
-	"database/sql"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/mod/sumdb/tlog"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -15,8 +16,23 @@ type getEntriesItem struct {
 	ExtraData []byte `json:"extra_data"`
 }
 
+// integrityError indicates that data downloaded from the log is inconsistent with the STH
+type integrityError struct {
+	err error
+}
+
+func (e *integrityError) Error() string {
+	return "upstream integrity error: " + e.err.Error()
+}
+
+func (e *integrityError) Unwrap() error {
+	return e.err
+}
+
 type entry struct {
 	timestampedEntry []byte
+	certificate      []byte // certificate entry's certificate; nil for precertificate entries
+	tbsCertificate   []byte // precertificate entry's TBSCertificate (with poison removed); nil for certificate entries
 	precertificate   []byte // nil iff certificate entry; non-nil iff precertificate entry
 	chain            [][32]byte
 }
@@ -31,7 +47,6 @@ func decodeUint40(buf [5]byte) (i uint64) {
 }
 
 func (e *entry) parse(input []byte, leafIndex uint64) ([]byte, error) {
-	var skipped cryptobyte.String
 	str := cryptobyte.String(input)
 
 	// TimestampedEntry.timestamp
@@ -44,17 +59,23 @@ func (e *entry) parse(input []byte, leafIndex uint64) ([]byte, error) {
 		return nil, fmt.Errorf("error reading entry type")
 	}
 	// TimestampedEntry.signed_entry
+	e.certificate = nil
+	e.tbsCertificate = nil
 	if entryType == 0 {
-		if !str.ReadUint24LengthPrefixed(&skipped) {
+		var certificate cryptobyte.String
+		if !str.ReadUint24LengthPrefixed(&certificate) {
 			return nil, fmt.Errorf("error reading certificate")
 		}
+		e.certificate = certificate
 	} else if entryType == 1 {
 		if !str.Skip(32) {
 			return nil, fmt.Errorf("error reading issuer_key_hash")
 		}
-		if !str.ReadUint24LengthPrefixed(&skipped) {
+		var tbsCertificate cryptobyte.String
+		if !str.ReadUint24LengthPrefixed(&tbsCertificate) {
 			return nil, fmt.Errorf("error reading tbs_certificate")
 		}
+		e.tbsCertificate = tbsCertificate
 	} else {
 		return nil, fmt.Errorf("invalid entry type %d", entryType)
 	}
@@ -123,6 +144,22 @@ func (e *entry) parse(input []byte, leafIndex uint64) ([]byte, error) {
 	return str, nil
 }
 
+// cert returns the entry's certificate, or precertificate for precertificate entries
+func (e *entry) cert() []byte {
+	if e.precertificate != nil {
+		return e.precertificate
+	}
+	return e.certificate
+}
+
+func (e *entry) timestamp() uint64 {
+	return binary.BigEndian.Uint64(e.timestampedEntry)
+}
+
+func (e *entry) certSHA256() [32]byte {
+	return sha256.Sum256(e.cert())
+}
+
 func (e *entry) leafInput() []byte {
 	return append([]byte{0, 0}, e.timestampedEntry...)
 }
@@ -145,11 +182,84 @@ func (e *entry) extraData(issuers map[[32]byte]*[]byte) []byte {
 }
 
 func (srv *Server) downloadEntries(ctx context.Context, sth *signedTreeHead, beginIncl, endExcl uint64) ([]getEntriesItem, error) {
-	tile := beginIncl / entriesPerTile
-	skip := beginIncl % entriesPerTile
-	numEntries := min(entriesPerTile, endExcl-tile*entriesPerTile) - skip
+	firstTile := beginIncl / entriesPerTile
+	lastTile := (endExcl - 1) / entriesPerTile
+	tileEntries := make([][]entry, lastTile-firstTile+1)
 
-	data, err := downloadTile(ctx, srv.userAgent, sth, srv.monitoringPrefix, "data", tile)
+	group, groupCtx := errgroup.WithContext(ctx)
+	for i := range tileEntries {
+		tile := firstTile + uint64(i)
+		skip := max(beginIncl, tile*entriesPerTile) - tile*entriesPerTile
+		count := min(endExcl, (tile+1)*entriesPerTile) - tile*entriesPerTile - skip
+		group.Go(func() error {
+			entries, err := srv.downloadDataTile(groupCtx, sth, tile, skip, count)
+			if err != nil {
+				return err
+			}
+			tileEntries[i] = entries
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	issuers := make(map[[32]byte]*[]byte)
+	var entries []entry
+	for _, tileEntries := range tileEntries {
+		for i := range tileEntries {
+			for _, issuer := range tileEntries[i].chain {
+				if _, exists := issuers[issuer]; !exists {
+					issuers[issuer] = new([]byte)
+				}
+			}
+		}
+		entries = append(entries, tileEntries...)
+	}
+
+	if srv.verifyEntries {
+		if err := srv.checkEntries(ctx, sth, beginIncl, entries); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := srv.getIssuers(ctx, issuers); err != nil {
+		return nil, err
+	}
+
+	items := make([]getEntriesItem, len(entries))
+	for i := range entries {
+		items[i].LeafInput = entries[i].leafInput()
+		items[i].ExtraData = entries[i].extraData(issuers)
+	}
+	return items, nil
+}
+
+// checkEntries checks that the leaf hash of each entry, starting at leaf index
+// beginIncl, matches the level 0 hash committed to by sth
+func (srv *Server) checkEntries(ctx context.Context, sth *signedTreeHead, beginIncl uint64, entries []entry) error {
+	indexes := make([]int64, len(entries))
+	for i := range entries {
+		indexes[i] = tlog.StoredHashIndex(0, int64(beginIncl)+int64(i))
+	}
+	hashes, err := srv.hashReader(ctx, sth).ReadHashes(indexes)
+	if err != nil {
+		return fmt.Errorf("error reading leaf hashes: %w", err)
+	}
+	for i := range entries {
+		if leafHash := tlog.RecordHash(entries[i].leafInput()); leafHash != hashes[i] {
+			err := &integrityError{fmt.Errorf("entry %d has leaf hash %x, but the tree with size %d contains %x", beginIncl+uint64(i), leafHash[:], sth.TreeSize, hashes[i][:])}
+			srv.metrics.integrityErrors.inc(nil)
+			srv.log.Print(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// downloadDataTile downloads the given data tile and parses count entries, starting skip entries into the tile
+func (srv *Server) downloadDataTile(ctx context.Context, sth *signedTreeHead, tile uint64, skip uint64, count uint64) ([]entry, error) {
+	data, err := srv.fetchTile(ctx, sth, -1, tile)
 	if err != nil {
 		return nil, err
 	}
@@ -162,32 +272,16 @@ func (srv *Server) downloadEntries(ctx context.Context, sth *signedTreeHead, beg
 			data = rest
 		}
 	}
-	issuers := make(map[[32]byte]*[]byte)
-	entries := make([]entry, numEntries)
-	for i := range numEntries {
+	entries := make([]entry, count)
+	for i := range count {
 		leafIndex := tile*entriesPerTile + skip + i
 		if rest, err := entries[i].parse(data, leafIndex); err != nil {
 			return nil, fmt.Errorf("error parsing entry %d: %w", leafIndex, err)
 		} else {
 			data = rest
 		}
-		for _, issuer := range entries[i].chain {
-			if _, exists := issuers[issuer]; !exists {
-				issuers[issuer] = new([]byte)
-			}
-		}
-	}
-
-	if err := srv.getIssuers(ctx, issuers); err != nil {
-		return nil, err
-	}
-
-	items := make([]getEntriesItem, numEntries)
-	for i := range numEntries {
-		items[i].LeafInput = entries[i].leafInput()
-		items[i].ExtraData = entries[i].extraData(issuers)
 	}
-	return items, nil
+	return entries, nil
 }
 
 func (srv *Server) getIssuers(ctx context.Context, issuers map[[32]byte]*[]byte) error {
@@ -207,30 +301,23 @@ func (srv *Server) getIssuers(ctx context.Context, issuers map[[32]byte]*[]byte)
 }
 
 func (srv *Server) getIssuer(ctx context.Context, fingerprint [32]byte) ([]byte, error) {
-	if srv.db != nil {
-		var data []byte
-		if err := srv.db.QueryRowContext(ctx, `SELECT data FROM issuer WHERE sha256 = $1`, fingerprint[:]).Scan(&data); err == nil {
-			return data, nil
-		} else if err != sql.ErrNoRows {
-			return nil, fmt.Errorf("error loading issuer from database: %w", err)
-		}
-	} else if cached, ok := srv.issuerCache.Load(fingerprint); ok {
-		return cached.([]byte), nil
+	if data, ok, err := srv.issuers.load(ctx, fingerprint); err != nil {
+		return nil, err
+	} else if ok {
+		srv.metrics.issuerCache.inc(labels{"result", "hit"})
+		return data, nil
 	}
+	srv.metrics.issuerCache.inc(labels{"result", "miss"})
 	issuerURL := srv.monitoringPrefix.JoinPath("issuer", hex.EncodeToString(fingerprint[:]))
-	data, err := downloadRetry(ctx, srv.userAgent, issuerURL.String())
+	data, err := srv.downloadRetry(ctx, issuerURL.String())
 	if err != nil {
 		return nil, err
 	}
 	if sha256.Sum256(data) != fingerprint {
 		return nil, fmt.Errorf("response from %s does not match the fingerprint", issuerURL)
 	}
-	if srv.db != nil {
-		if _, err := srv.db.ExecContext(ctx, `INSERT INTO issuer (sha256, data) VALUES ($1, $2) ON CONFLICT (sha256) DO NOTHING`, fingerprint[:], data); err != nil {
-			return nil, fmt.Errorf("error storing issuer in databaes: %w", err)
-		}
-	} else {
-		srv.issuerCache.Store(fingerprint, data)
+	if err := srv.issuers.store(ctx, fingerprint, data); err != nil {
+		return nil, err
 	}
 	return data, nil
 }
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"software.sslmate.com/src/certspotter/merkletree"
+	"time"
+)
+
+// runFrontend periodically reloads the state written to the database by
+// another instance which indexes the log, until ctx is done
+func (srv *Server) runFrontend(ctx context.Context) error {
+	ticker := time.NewTicker(srv.pollInterval)
+	defer ticker.Stop()
+	for {
+		if err := srv.reloadState(ctx); ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			srv.log.Printf("error reloading state from database (will try again later): %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (srv *Server) reloadState(ctx context.Context) error {
+	sth, err := srv.loadSTH(ctx)
+	if err != nil {
+		return err
+	} else if sth == nil {
+		return nil
+	}
+	// loaded after the STH, so it's at least as new
+	var position merkletree.FragmentedCollapsedTree
+	if err := srv.loadPosition(ctx, &position); err != nil {
+		return err
+	}
+	contactTime, err := srv.storage.LoadContactTime(ctx)
+	if err != nil {
+		return err
+	}
+	if srv.localProofs {
+		proofSize, err := srv.tiles.LoadProofSize(ctx)
+		if err != nil {
+			return err
+		}
+		srv.proofSize.Store(proofSize)
+	}
+	if srv.indexes != nil {
+		if err := srv.loadIndexCoverage(ctx); err != nil {
+			return err
+		}
+	}
+	srv.indexedSize.Store(indexedPrefix(&position))
+	srv.indexingStatus.begin(unindexedGaps(&position, sth.TreeSize))
+	srv.upstreamSTH.Store(sth)
+	srv.sth.Store(sth)
+	if !contactTime.IsZero() {
+		// the indexer's contact with the log, not this reload, determines freshness
+		srv.lastUpstreamContact.Store(contactTime.UnixNano())
+	}
+	return nil
+}
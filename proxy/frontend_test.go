@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestFrontendReadiness(t *testing.T) {
+	ctx := context.Background()
+	log := newFakeLog(t, 10)
+	upstream := httptest.NewServer(log)
+	defer upstream.Close()
+	prefix, err := url.Parse(upstream.URL + "/log/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.origin = originFromSubmissionPrefix(prefix)
+
+	storage := openTestSQLStorage(t)
+	newServer := func(frontend bool) *Server {
+		srv, err := NewServer(&Config{
+			LogID:             log.logID,
+			SubmissionPrefix:  prefix,
+			MonitoringPrefix:  prefix,
+			Storage:           storage,
+			Frontend:          frontend,
+			ReadyMaxStaleness: time.Minute,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return srv
+	}
+	indexer := newServer(false)
+	frontend := newServer(true)
+
+	if err := frontend.reloadState(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if resp := frontend.readyz(); resp.Ready {
+		t.Error("frontend is ready before the log has been indexed")
+	}
+
+	if err := indexer.tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := frontend.reloadState(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if resp := frontend.readyz(); !resp.Ready {
+		t.Errorf("frontend isn't ready after the log has been indexed: %v", resp.Problems)
+	}
+
+	// the indexer stops contacting the log; reloading the state must not
+	// make it look fresh
+	if err := storage.StoreContactTime(ctx, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := frontend.reloadState(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if resp := frontend.readyz(); resp.Ready {
+		t.Error("frontend is ready even though the indexer last contacted the log an hour ago")
+	}
+}
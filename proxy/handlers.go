@@ -1,9 +1,9 @@
 package proxy
 
 import (
-	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"golang.org/x/mod/sumdb/tlog"
 	"net/http"
@@ -93,16 +93,28 @@ func (srv *Server) getProofByHash(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "Invalid tree_size parameter: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	if srv.disableLeafIndex || srv.db == nil {
+	if srv.disableLeafIndex || srv.storage == nil {
 		http.Error(w, "This log does not implement the get-proof-by-hash endpoint", http.StatusNotImplemented)
 		return
 	}
-	var leafIndex uint64
-	if err := srv.db.QueryRowContext(req.Context(), `SELECT position FROM leaf WHERE hash = $1`, hash[:]).Scan(&leafIndex); err == sql.ErrNoRows {
+	// When serving unindexed STHs, a lookup is only authoritative if the
+	// leaves it could refer to have all been indexed, since the leaf index
+	// stores the first position of each hash.
+	indexedSize := srv.indexedSize.Load()
+	leafIndex, found, err := srv.storage.LookupLeaf(req.Context(), hash[:])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !found {
+		if srv.serveUnindexedSTH && treeSize > indexedSize {
+			http.Error(w, fmt.Sprintf("hash not found in the first %d leaves, which are the only ones indexed so far", indexedSize), http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, "hash not found", http.StatusBadRequest)
 		return
-	} else if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	if srv.serveUnindexedSTH && leafIndex >= indexedSize {
+		http.Error(w, fmt.Sprintf("hash is not within the first %d leaves, which are the only ones indexed so far", indexedSize), http.StatusServiceUnavailable)
 		return
 	}
 	if leafIndex >= treeSize {
@@ -169,10 +181,11 @@ func (srv *Server) getEntries(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, fmt.Sprintf("end is beyond the current tree size (%d)", sth.TreeSize), http.StatusBadRequest)
 		return
 	}
+	end = min(end, start+srv.maxGetEntries-1, (start/entriesPerTile+srv.getEntriesTiles)*entriesPerTile-1)
 
 	entries, err := srv.downloadEntries(req.Context(), sth, start, end+1)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), entriesErrorStatus(err))
 		return
 	}
 
@@ -218,7 +231,7 @@ func (srv *Server) getEntryAndProof(w http.ResponseWriter, req *http.Request) {
 
 	entries, err := srv.downloadEntries(req.Context(), sth, leafIndex, leafIndex+1)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), entriesErrorStatus(err))
 		return
 	}
 
@@ -241,3 +254,10 @@ func (srv *Server) getEntryAndProof(w http.ResponseWriter, req *http.Request) {
 		AuditPath: proof,
 	})
 }
+
+func entriesErrorStatus(err error) int {
+	if errors.As(err, new(*integrityError)) {
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"software.sslmate.com/src/certspotter/merkletree"
+	"sync"
+	"time"
+)
+
+type gap struct {
+	begin, end uint64
+}
+
+// unindexedGaps returns the ranges of the first treeSize leaves which are not contained in position
+func unindexedGaps(position *merkletree.FragmentedCollapsedTree, treeSize uint64) []gap {
+	var gaps []gap
+	for begin, end := range position.Gaps {
+		if end == 0 || end > treeSize {
+			end = treeSize
+		}
+		if begin < end {
+			gaps = append(gaps, gap{begin, end})
+		}
+	}
+	return gaps
+}
+
+func gapsSize(gaps []gap) (size uint64) {
+	for _, g := range gaps {
+		size += g.end - g.begin
+	}
+	return
+}
+
+// indexingStatus tracks the progress of the current (or most recent) indexing run
+type indexingStatus struct {
+	mu               sync.Mutex
+	gaps             []gap
+	started          time.Time
+	initialRemaining uint64
+}
+
+func (status *indexingStatus) begin(gaps []gap) {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	status.gaps = gaps
+	status.started = time.Now()
+	status.initialRemaining = gapsSize(gaps)
+}
+
+func (status *indexingStatus) update(gaps []gap) {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	status.gaps = gaps
+}
+
+// snapshot returns the current gaps and the estimated time until they are indexed (-1 if unknown)
+func (status *indexingStatus) snapshot() ([]gap, time.Duration) {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	remaining := gapsSize(status.gaps)
+	if remaining == 0 {
+		return status.gaps, 0
+	}
+	indexed := status.initialRemaining - remaining
+	elapsed := time.Since(status.started)
+	if indexed == 0 || elapsed <= 0 {
+		return status.gaps, -1
+	}
+	return status.gaps, time.Duration(float64(elapsed) * float64(remaining) / float64(indexed))
+}
+
+type healthResponse struct {
+	Ready               bool        `json:"ready"`
+	Problems            []string    `json:"problems,omitempty"`
+	IndexedSize         uint64      `json:"indexed_size"`
+	UpstreamSize        uint64      `json:"upstream_size"`
+	LastUpstreamContact *time.Time  `json:"last_upstream_contact,omitempty"`
+	Gaps                [][2]uint64 `json:"gaps"`
+	ETASeconds          *float64    `json:"eta_seconds,omitempty"`
+}
+
+func (srv *Server) healthStatus() *healthResponse {
+	resp := &healthResponse{Gaps: [][2]uint64{}}
+	if srv.storage != nil && !srv.disableLeafIndex {
+		resp.IndexedSize = srv.indexedSize.Load()
+	} else if sth := srv.sth.Load(); sth != nil {
+		// without a leaf index, the served tree is as indexed as it gets
+		resp.IndexedSize = sth.TreeSize
+	}
+	if sth := srv.upstreamSTH.Load(); sth != nil {
+		resp.UpstreamSize = sth.TreeSize
+	}
+	if nanos := srv.lastUpstreamContact.Load(); nanos != 0 {
+		t := time.Unix(0, nanos)
+		resp.LastUpstreamContact = &t
+	}
+	gaps, eta := srv.indexingStatus.snapshot()
+	for _, g := range gaps {
+		resp.Gaps = append(resp.Gaps, [2]uint64{g.begin, g.end})
+	}
+	if eta >= 0 {
+		seconds := eta.Seconds()
+		resp.ETASeconds = &seconds
+	}
+	return resp
+}
+
+func writeHealth(w http.ResponseWriter, ready bool, resp any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+	if ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// healthz reports whether the process is alive and its database is reachable,
+// if the storage can be pinged
+func (srv *Server) healthz(ctx context.Context) *healthResponse {
+	resp := srv.healthStatus()
+	resp.Ready = true
+	if pinger, ok := srv.storage.(interface{ Ping(context.Context) error }); ok {
+		if err := pinger.Ping(ctx); err != nil {
+			resp.Ready = false
+			resp.Problems = append(resp.Problems, "database is unreachable: "+err.Error())
+		}
+	}
+	return resp
+}
+
+// readyz reports whether the proxy is able to serve up-to-date responses
+func (srv *Server) readyz() *healthResponse {
+	resp := srv.healthStatus()
+	if srv.sth.Load() == nil {
+		resp.Problems = append(resp.Problems, "no STH has been loaded yet")
+	}
+	if resp.LastUpstreamContact == nil {
+		resp.Problems = append(resp.Problems, "log has not been contacted yet")
+	} else if age := time.Since(*resp.LastUpstreamContact); age > srv.readyMaxStaleness {
+		resp.Problems = append(resp.Problems, fmt.Sprintf("log was last contacted %s ago", age.Round(time.Second)))
+	}
+	if since := srv.witnessStallSince.Load(); since != 0 {
+		if stall := time.Since(time.Unix(0, since)); stall > srv.readyMaxStaleness {
+			resp.Problems = append(resp.Problems, fmt.Sprintf("checkpoints have lacked a witness quorum for %s", stall.Round(time.Second)))
+		}
+	}
+	if lag := resp.UpstreamSize - min(resp.IndexedSize, resp.UpstreamSize); lag > srv.readyMaxLag {
+		resp.Problems = append(resp.Problems, fmt.Sprintf("served tree is %d entries behind the log", lag))
+	}
+	resp.Ready = len(resp.Problems) == 0
+	return resp
+}
+
+func (srv *Server) getHealthz(w http.ResponseWriter, req *http.Request) {
+	resp := srv.healthz(req.Context())
+	writeHealth(w, resp.Ready, resp)
+}
+
+func (srv *Server) getReadyz(w http.ResponseWriter, req *http.Request) {
+	resp := srv.readyz()
+	writeHealth(w, resp.Ready, resp)
+}
+
+type combinedHealthResponse struct {
+	Ready bool                       `json:"ready"`
+	Logs  map[string]*healthResponse `json:"logs"` // keyed by monitoring prefix
+}
+
+func combinedHealthHandler(servers []*Server, status func(*Server, *http.Request) *healthResponse) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		resp := &combinedHealthResponse{Ready: true, Logs: make(map[string]*healthResponse)}
+		for _, srv := range servers {
+			logResp := status(srv, req)
+			resp.Ready = resp.Ready && logResp.Ready
+			resp.Logs[srv.monitoringPrefix.String()] = logResp
+		}
+		writeHealth(w, resp.Ready, resp)
+	})
+}
+
+// HealthzHandler returns a handler like /healthz which only succeeds if it
+// succeeds for every one of the given servers.
+func HealthzHandler(servers []*Server) http.Handler {
+	return combinedHealthHandler(servers, func(srv *Server, req *http.Request) *healthResponse { return srv.healthz(req.Context()) })
+}
+
+// ReadyzHandler returns a handler like /readyz which only succeeds if it
+// succeeds for every one of the given servers.
+func ReadyzHandler(servers []*Server) http.Handler {
+	return combinedHealthHandler(servers, func(srv *Server, req *http.Request) *healthResponse { return srv.readyz() })
+}
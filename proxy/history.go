@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// latestAcceptedSTH returns the largest STH accepted from the log, or nil if none
+func (srv *Server) latestAcceptedSTH(ctx context.Context) (*signedTreeHead, error) {
+	if srv.history == nil {
+		return srv.upstreamSTH.Load(), nil
+	}
+	record, err := srv.history.LoadLatestSTHRecord(ctx)
+	if err != nil {
+		return nil, err
+	} else if record == nil {
+		// storage created before the STH history existed only has the served STH
+		return srv.sth.Load(), nil
+	}
+	return &signedTreeHead{
+		TreeSize:          record.TreeSize,
+		Timestamp:         record.Timestamp,
+		SHA256RootHash:    record.RootHash,
+		TreeHeadSignature: record.Signature,
+		checkpoint:        record.Checkpoint,
+	}, nil
+}
+
+// acceptSTH checks that sth is consistent with the latest accepted STH and,
+// if so, records it in the STH history.  If sth is inconsistent, an alert is
+// raised and false is returned.
+func (srv *Server) acceptSTH(ctx context.Context, sth *signedTreeHead) (bool, error) {
+	prev, err := srv.latestAcceptedSTH(ctx)
+	if err != nil {
+		return false, err
+	}
+	if prev != nil {
+		alert := func(kind string, format string, args ...any) {
+			srv.raiseAlert(ctx, &Alert{
+				Type:               kind,
+				Message:            fmt.Sprintf(format, args...),
+				Checkpoint:         string(sth.checkpoint),
+				PreviousCheckpoint: string(prev.checkpoint),
+			})
+		}
+		if sth.TreeSize < prev.TreeSize {
+			alert("rewind", "log presented STH with tree size %d, which is smaller than previously-seen tree size %d", sth.TreeSize, prev.TreeSize)
+			return false, nil
+		} else if sth.Timestamp < prev.Timestamp {
+			alert("timestamp", "log presented STH with timestamp %d, which is older than previously-seen timestamp %d", sth.Timestamp, prev.Timestamp)
+			return false, nil
+		} else if sth.TreeSize == prev.TreeSize {
+			if !bytes.Equal(sth.SHA256RootHash, prev.SHA256RootHash) {
+				alert("fork", "log presented two STHs with tree size %d but different root hashes (%x and %x)", sth.TreeSize, prev.SHA256RootHash, sth.SHA256RootHash)
+				return false, nil
+			}
+		} else if prev.TreeSize > 0 {
+			hashReader := tlog.TileHashReader(sth.tlogTree(), &tileReader{ctx: ctx, srv: srv})
+			proof, err := tlog.ProveTree(int64(sth.TreeSize), int64(prev.TreeSize), hashReader)
+			if errors.As(err, new(tileReadError)) {
+				return false, logContactError{fmt.Errorf("error building consistency proof from tree size %d to %d: %w", prev.TreeSize, sth.TreeSize, err)}
+			} else if err != nil {
+				// the log's tiles (or those stored from it) don't match the root hash
+				alert("fork", "tiles for STH with tree size %d and root hash %x are inconsistent with it, so it can't be proven consistent with previously-seen STH with tree size %d and root hash %x: %s", sth.TreeSize, sth.SHA256RootHash, prev.TreeSize, prev.SHA256RootHash, err)
+				return false, nil
+			}
+			if err := tlog.CheckTree(proof, int64(sth.TreeSize), tlog.Hash(sth.SHA256RootHash), int64(prev.TreeSize), tlog.Hash(prev.SHA256RootHash)); err != nil {
+				alert("fork", "STH with tree size %d and root hash %x is not consistent with previously-seen STH with tree size %d and root hash %x: %s", sth.TreeSize, sth.SHA256RootHash, prev.TreeSize, prev.SHA256RootHash, err)
+				return false, nil
+			}
+		}
+	}
+	if srv.history != nil {
+		if err := srv.history.AddSTHRecord(ctx, &STHRecord{
+			TreeSize:   sth.TreeSize,
+			Timestamp:  sth.Timestamp,
+			RootHash:   sth.SHA256RootHash,
+			Signature:  sth.TreeHeadSignature,
+			Checkpoint: sth.checkpoint,
+		}); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAcceptSTHInconsistentTiles(t *testing.T) {
+	ctx := context.Background()
+	log := newFakeLog(t, 300)
+	upstream := httptest.NewServer(log)
+	defer upstream.Close()
+	prefix, err := url.Parse(upstream.URL + "/log/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.origin = originFromSubmissionPrefix(prefix)
+
+	alerts := new(testAlertSink)
+	srv, err := NewServer(&Config{
+		LogID:            log.logID,
+		SubmissionPrefix: prefix,
+		MonitoringPrefix: prefix,
+		Storage:          NewMemoryStorage(),
+		AlertSinks:       []AlertSink{alerts},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// tiles which can't be downloaded are a problem contacting the log
+	log.grow(t, 600)
+	log.timestamp++
+	log.noPartial = true
+	if err := srv.tick(ctx); !isLogContactError(err) {
+		t.Errorf("tick didn't fail with a log contact error: %v", err)
+	}
+	srv.pendingAlerts.Wait()
+	if len(alerts.types) != 0 {
+		t.Errorf("alerts were raised for tiles which couldn't be downloaded: %v", alerts.types)
+	}
+
+	// tiles which don't match the root hash are evidence of a fork
+	log.noPartial = false
+	log.badRoot = true
+	if err := srv.tick(ctx); err != nil {
+		t.Errorf("tick failed: %s", err)
+	}
+	if sth := srv.upstreamSTH.Load(); sth.TreeSize != 300 {
+		t.Errorf("upstream STH was advanced to tree size %d", sth.TreeSize)
+	}
+	srv.pendingAlerts.Wait()
+	if len(alerts.types) != 1 || alerts.types[0] != "fork" {
+		t.Errorf("expected a fork alert, not %v", alerts.types)
+	}
+}
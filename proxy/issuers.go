@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"src.agwa.name/sunglasses/proxy/schema"
+)
+
+// issuerStorage is the part of Storage which an IssuerStore uses
+type issuerStorage interface {
+	io.Closer
+	GetIssuer(ctx context.Context, fingerprint [32]byte) ([]byte, bool, error)
+	PutIssuer(ctx context.Context, fingerprint [32]byte, data []byte) error
+}
+
+// IssuerStore caches issuer certificates by SHA-256 fingerprint.  Since
+// fingerprints don't depend on the log, a single IssuerStore can be shared
+// by many Servers.
+type IssuerStore struct {
+	storage issuerStorage
+	close   bool // whether Close should close storage
+}
+
+// NewIssuerStore returns an IssuerStore which caches issuers in memory.
+func NewIssuerStore() *IssuerStore {
+	return &IssuerStore{storage: NewMemoryStorage()}
+}
+
+// OpenIssuerStore returns an IssuerStore which caches issuers in the
+// SQLite database at dbPath, which will be created if necessary, or the
+// PostgreSQL database if dbPath is a postgres:// URL.  The database only
+// contains issuers, so it can't also be used as the DBPath of a Server.
+func OpenIssuerStore(dbPath string) (*IssuerStore, error) {
+	db, err := openDB(dbPath, "NORMAL", schema.IssuerFiles, schema.IssuerPostgresFiles)
+	if err != nil {
+		return nil, err
+	}
+	// only the issuer methods of SQLStorage are used, since the database
+	// has no other tables
+	return &IssuerStore{storage: &SQLStorage{db: db}, close: true}, nil
+}
+
+func (store *IssuerStore) Close() error {
+	if store.close {
+		return store.storage.Close()
+	}
+	return nil
+}
+
+func (store *IssuerStore) load(ctx context.Context, fingerprint [32]byte) ([]byte, bool, error) {
+	return store.storage.GetIssuer(ctx, fingerprint)
+}
+
+func (store *IssuerStore) store(ctx context.Context, fingerprint [32]byte, data []byte) error {
+	return store.storage.PutIssuer(ctx, fingerprint, data)
+}
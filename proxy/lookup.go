@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/mod/sumdb/tlog"
+	"math"
+	"net/http"
+	"net/url"
+	"software.sslmate.com/src/certspotter/merkletree"
+	"strconv"
+)
+
+// Non-standard endpoints for looking up entries, under /sunglasses/v1/
+
+// noCoverage is the coverage start of an index which isn't maintained
+const noCoverage = math.MaxUint64
+
+// initIndexCoverage records the first leaf index from which each index is
+// complete.  Nothing backfills an index, so one which is enabled after
+// entries were indexed only covers the entries after them, and one which is
+// disabled loses its coverage, since entries indexed meanwhile are missing.
+func (srv *Server) initIndexCoverage(ctx context.Context) error {
+	var position merkletree.FragmentedCollapsedTree
+	if err := srv.loadPosition(ctx, &position); err != nil {
+		return err
+	}
+	var start uint64
+	if n := position.NumSubtrees(); n > 0 {
+		last := position.Subtree(n - 1)
+		start = last.Offset() + last.Size()
+	}
+	starts, err := srv.indexes.LoadIndexStarts(ctx)
+	if err != nil {
+		return err
+	}
+	for _, index := range []struct {
+		start   **uint64
+		enabled bool
+	}{
+		{&starts.Cert, srv.certIndex},
+		{&starts.DNS, srv.dnsIndex},
+		{&starts.Precert, srv.precertIndex},
+	} {
+		if !index.enabled {
+			*index.start = nil
+		} else if *index.start == nil {
+			*index.start = &start
+		}
+	}
+	if err := srv.indexes.StoreIndexStarts(ctx, starts); err != nil {
+		return err
+	}
+	return srv.loadIndexCoverage(ctx)
+}
+
+func (srv *Server) loadIndexCoverage(ctx context.Context) error {
+	starts, err := srv.indexes.LoadIndexStarts(ctx)
+	if err != nil {
+		return err
+	}
+	coverageStart := func(start *uint64) uint64 {
+		if start == nil {
+			return noCoverage
+		}
+		return *start
+	}
+	srv.certIndexStart.Store(coverageStart(starts.Cert))
+	srv.dnsIndexStart.Store(coverageStart(starts.DNS))
+	srv.precertIndexStart.Store(coverageStart(starts.Precert))
+	return nil
+}
+
+// notCovered writes an error for a lookup which an index can't answer
+// because it only covers entries from start onward.  If the index has not
+// been built yet, that may change, so the status is 503.  Otherwise, the
+// index will never cover the earlier entries, so the status is 404, and the
+// Sunglasses-Index-Start header contains start.
+func notCovered(w http.ResponseWriter, index string, start uint64) {
+	if start == noCoverage {
+		http.Error(w, "the "+index+" has not been built yet", http.StatusServiceUnavailable)
+	} else {
+		w.Header().Set("Sunglasses-Index-Start", strconv.FormatUint(start, 10))
+		http.Error(w, fmt.Sprintf("not found; the %s only covers entries %d and later, since it was enabled after earlier entries were indexed", index, start), http.StatusNotFound)
+	}
+}
+
+// notFound writes an error for a lookup which found nothing in an index
+// which covers entries from start onward
+func notFound(w http.ResponseWriter, what string, index string, start uint64, indexedSize uint64, treeSize uint64) {
+	if start == noCoverage {
+		notCovered(w, index, start)
+	} else if indexedSize < treeSize {
+		notYetIndexed(w, indexedSize, treeSize)
+	} else if start > 0 {
+		notCovered(w, index, start)
+	} else {
+		http.Error(w, what+" not found", http.StatusNotFound)
+	}
+}
+
+// notYetIndexed writes an error for a lookup which can't be answered
+// authoritatively because only the first indexedSize leaves of the served
+// tree have been indexed so far, which happens when serving unindexed STHs
+func notYetIndexed(w http.ResponseWriter, indexedSize uint64, treeSize uint64) {
+	http.Error(w, fmt.Sprintf("only the first %d leaves of the tree (size %d) have been indexed so far", indexedSize, treeSize), http.StatusServiceUnavailable)
+}
+
+type lookupResponse struct {
+	LeafIndex uint64      `json:"leaf_index"`
+	TreeSize  uint64      `json:"tree_size"`
+	LeafInput []byte      `json:"leaf_input"`
+	ExtraData []byte      `json:"extra_data"`
+	AuditPath []tlog.Hash `json:"audit_path"`
+}
+
+func (srv *Server) lookupByCertSHA256(w http.ResponseWriter, req *http.Request) {
+	query, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		http.Error(w, "Invalid query string: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	fingerprint, err := hex.DecodeString(query.Get("sha256"))
+	if err != nil {
+		http.Error(w, "Invalid sha256 parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(fingerprint) != 32 {
+		http.Error(w, fmt.Sprintf("Invalid sha256 parameter: wrong length (should be 32 bytes long, not %d)", len(fingerprint)), http.StatusBadRequest)
+		return
+	}
+	if !srv.certIndex {
+		http.Error(w, "This log does not have a certificate index", http.StatusNotImplemented)
+		return
+	}
+	sth := srv.sth.Load()
+	if sth == nil {
+		http.Error(w, "not yet synchronized with upstream log", http.StatusServiceUnavailable)
+		return
+	}
+	// as in getProofByHash, a miss is only authoritative if every leaf of
+	// the served tree has been indexed
+	indexedSize := srv.indexedSize.Load()
+	leafIndex, found, err := srv.indexes.LookupCert(req.Context(), fingerprint)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !found {
+		notFound(w, "certificate", "certificate index", srv.certIndexStart.Load(), indexedSize, sth.TreeSize)
+		return
+	}
+	srv.writeLookupResponse(w, req, sth, leafIndex)
+}
+
+// writeLookupResponse writes the entry at leafIndex along with an inclusion proof against sth
+func (srv *Server) writeLookupResponse(w http.ResponseWriter, req *http.Request, sth *signedTreeHead, leafIndex uint64) {
+	if leafIndex >= sth.TreeSize {
+		http.Error(w, fmt.Sprintf("certificate not found in the current tree (size %d)", sth.TreeSize), http.StatusNotFound)
+		return
+	}
+	entries, err := srv.downloadEntries(req.Context(), sth, leafIndex, leafIndex+1)
+	if err != nil {
+		http.Error(w, err.Error(), entriesErrorStatus(err))
+		return
+	}
+	proof, err := tlog.ProveRecord(int64(sth.TreeSize), int64(leafIndex), srv.hashReader(req.Context(), sth))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(lookupResponse{
+		LeafIndex: leafIndex,
+		TreeSize:  sth.TreeSize,
+		LeafInput: entries[0].LeafInput,
+		ExtraData: entries[0].ExtraData,
+		AuditPath: proof,
+	})
+}
+
+const maxSearchResults = 1000
+
+func (srv *Server) searchDNSName(w http.ResponseWriter, req *http.Request) {
+	query, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		http.Error(w, "Invalid query string: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name, ok := normalizeDNSName(query.Get("name"))
+	if !ok {
+		http.Error(w, "Invalid name parameter", http.StatusBadRequest)
+		return
+	}
+	var subdomains bool
+	if query.Has("subdomains") {
+		if subdomains, err = strconv.ParseBool(query.Get("subdomains")); err != nil {
+			http.Error(w, "Invalid subdomains parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var start uint64
+	if query.Has("start") {
+		if start, err = strconv.ParseUint(query.Get("start"), 10, 64); err != nil {
+			http.Error(w, "Invalid start parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !srv.dnsIndex {
+		http.Error(w, "This log does not have a DNS name index", http.StatusNotImplemented)
+		return
+	}
+	sth := srv.sth.Load()
+	if sth == nil {
+		http.Error(w, "not yet synchronized with upstream log", http.StatusServiceUnavailable)
+		return
+	}
+
+	if indexStart := srv.dnsIndexStart.Load(); start < indexStart {
+		notCovered(w, "DNS name index", indexStart)
+		return
+	}
+	// otherwise an incomplete page would be indistinguishable from the last one
+	if indexedSize := srv.indexedSize.Load(); indexedSize < sth.TreeSize {
+		notYetIndexed(w, indexedSize, sth.TreeSize)
+		return
+	}
+
+	leafIndices, err := srv.indexes.SearchDNSName(req.Context(), name, subdomains, start, sth.TreeSize, maxSearchResults)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var nextStart *uint64
+	if len(leafIndices) == maxSearchResults {
+		next := leafIndices[len(leafIndices)-1] + 1
+		nextStart = &next
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		TreeSize    uint64   `json:"tree_size"`
+		LeafIndices []uint64 `json:"leaf_indices"`
+		NextStart   *uint64  `json:"next_start,omitempty"`
+	}{
+		TreeSize:    sth.TreeSize,
+		LeafIndices: leafIndices,
+		NextStart:   nextStart,
+	})
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotFound(t *testing.T) {
+	tests := []struct {
+		name        string
+		start       uint64
+		indexedSize uint64
+		status      int
+		indexStart  string
+	}{
+		{"complete index", 0, 100, http.StatusNotFound, ""},
+		{"not built yet", noCoverage, 100, http.StatusServiceUnavailable, ""},
+		{"not yet indexed", 0, 50, http.StatusServiceUnavailable, ""},
+		{"partial index, not yet indexed", 10, 50, http.StatusServiceUnavailable, ""},
+		{"partial index", 10, 100, http.StatusNotFound, "10"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		notFound(rec, "certificate", "certificate index", test.start, test.indexedSize, 100)
+		if rec.Code != test.status {
+			t.Errorf("%s: status is %d, not %d", test.name, rec.Code, test.status)
+		}
+		if got := rec.Header().Get("Sunglasses-Index-Start"); got != test.indexStart {
+			t.Errorf("%s: Sunglasses-Index-Start is %q, not %q", test.name, got, test.indexStart)
+		}
+	}
+}
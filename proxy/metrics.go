@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics are exported at /metrics in the Prometheus text exposition format
+type metrics struct {
+	requests         counterVec   // endpoint, code
+	requestDuration  histogramVec // endpoint
+	downloads        counterVec   // code
+	downloadRetries  counterVec   // code
+	downloadFailures counterVec   // code
+	issuerCache      counterVec   // result
+	indexedEntries   counterVec   // (no labels)
+	indexingRate     gaugeVec     // (no labels)
+	commitDuration   histogramVec // (no labels)
+	integrityErrors  counterVec   // (no labels)
+	alerts           counterVec   // type
+}
+
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requestDuration: histogramVec{buckets: latencyBuckets},
+		commitDuration:  histogramVec{buckets: latencyBuckets},
+	}
+}
+
+type labels []string // alternating names and values
+
+// labelValueEscaper escapes label values as specified by the text exposition
+// format, which only defines escapes for backslash, double quote, and newline
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (l labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < len(l); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l[i])
+		b.WriteString(`="`)
+		labelValueEscaper.WriteString(&b, l[i+1])
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (c *counterVec) add(l labels, delta float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]float64)
+	}
+	c.values[l.String()] += delta
+}
+
+func (c *counterVec) inc(l labels) {
+	c.add(l, 1)
+}
+
+// joinLabels adds extra to the label set key, which was produced by labels.String
+func joinLabels(extra labels, key string) string {
+	if len(extra) == 0 {
+		return key
+	} else if key == "" {
+		return extra.String()
+	} else {
+		s := extra.String()
+		return s[:len(s)-1] + "," + key[1:]
+	}
+}
+
+// write writes the samples of c, adding the extra labels to each
+func (c *counterVec) write(w io.Writer, name string, extra labels) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range slices.Sorted(maps.Keys(c.values)) {
+		fmt.Fprintf(w, "%s%s %s\n", name, joinLabels(extra, key), formatFloat(c.values[key]))
+	}
+}
+
+type gaugeVec struct {
+	counterVec
+}
+
+func (g *gaugeVec) set(l labels, value float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.values == nil {
+		g.values = make(map[string]float64)
+	}
+	g.values[l.String()] = value
+}
+
+type histogram struct {
+	counts []uint64 // one per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	mu      sync.Mutex
+	buckets []float64
+	values  map[string]*histogram
+}
+
+func (h *histogramVec) observe(l labels, value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.values == nil {
+		h.values = make(map[string]*histogram)
+	}
+	key := l.String()
+	hist := h.values[key]
+	if hist == nil {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	if i, _ := slices.BinarySearch(h.buckets, value); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.sum += value
+	hist.count++
+}
+
+func (h *histogramVec) observeSince(l labels, start time.Time) {
+	h.observe(l, time.Since(start).Seconds())
+}
+
+// write writes the samples of h, adding the extra labels to each
+func (h *histogramVec) write(w io.Writer, name string, extra labels) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range slices.Sorted(maps.Keys(h.values)) {
+		hist := h.values[key]
+		key := joinLabels(extra, key)
+		// insert the le label into the existing label set
+		prefix := "{"
+		if key != "" {
+			prefix = key[:len(key)-1] + ","
+		}
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%sle=%q} %d\n", name, prefix, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%sle=\"+Inf\"} %d\n", name, prefix, hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, key, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, key, hist.count)
+	}
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// statusRecorder records the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument wraps handler so that its requests are counted and timed under the given endpoint name
+func (srv *Server) instrument(endpoint string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(recorder, req)
+		srv.metrics.requests.inc(labels{"endpoint", endpoint, "code", strconv.Itoa(cmp.Or(recorder.status, http.StatusOK))})
+		srv.metrics.requestDuration.observeSince(labels{"endpoint", endpoint}, start)
+	})
+}
+
+func statusCodeLabel(code int) string {
+	if code == 0 {
+		return "error"
+	}
+	return strconv.Itoa(code)
+}
+
+// metricVec is implemented by counterVec, gaugeVec, and histogramVec
+type metricVec interface {
+	write(w io.Writer, name string, extra labels)
+}
+
+// treeSize is a metricVec containing the size of an STH
+type treeSize struct {
+	sth *atomic.Pointer[signedTreeHead]
+}
+
+func (t treeSize) write(w io.Writer, name string, extra labels) {
+	var size uint64
+	if sth := t.sth.Load(); sth != nil {
+		size = sth.TreeSize
+	}
+	fmt.Fprintf(w, "%s%s %d\n", name, extra, size)
+}
+
+// indexedTreeSize is a metricVec containing the number of leading leaves
+// which are in the leaf index
+type indexedTreeSize struct {
+	size *atomic.Uint64
+}
+
+func (t indexedTreeSize) write(w io.Writer, name string, extra labels) {
+	fmt.Fprintf(w, "%s%s %d\n", name, extra, t.size.Load())
+}
+
+var metricFamilies = []struct {
+	name, help, typ string
+	vec             func(*Server) metricVec
+}{
+	{"sunglasses_tree_size", "Size of the tree served by get-sth.", "gauge", func(srv *Server) metricVec { return treeSize{&srv.sth} }},
+	{"sunglasses_indexed_tree_size", "Number of leading entries of the log which are in the leaf index.", "gauge", func(srv *Server) metricVec { return indexedTreeSize{&srv.indexedSize} }},
+	{"sunglasses_upstream_tree_size", "Size of the latest checkpoint accepted from the log.", "gauge", func(srv *Server) metricVec { return treeSize{&srv.upstreamSTH} }},
+	{"sunglasses_indexed_entries_total", "Number of entries added to the leaf index.", "counter", func(srv *Server) metricVec { return &srv.metrics.indexedEntries }},
+	{"sunglasses_indexing_entries_per_second", "Indexing throughput of the most recent indexing run.", "gauge", func(srv *Server) metricVec { return &srv.metrics.indexingRate }},
+	{"sunglasses_http_requests_total", "Number of HTTP requests by endpoint and status code.", "counter", func(srv *Server) metricVec { return &srv.metrics.requests }},
+	{"sunglasses_http_request_duration_seconds", "Latency of HTTP requests by endpoint.", "histogram", func(srv *Server) metricVec { return &srv.metrics.requestDuration }},
+	{"sunglasses_upstream_downloads_total", "Number of download attempts from the log by status code (\"error\" if no response).", "counter", func(srv *Server) metricVec { return &srv.metrics.downloads }},
+	{"sunglasses_upstream_download_retries_total", "Number of download attempts from the log that were retried, by status code.", "counter", func(srv *Server) metricVec { return &srv.metrics.downloadRetries }},
+	{"sunglasses_upstream_download_failures_total", "Number of downloads from the log that failed after retries, by status code.", "counter", func(srv *Server) metricVec { return &srv.metrics.downloadFailures }},
+	{"sunglasses_issuer_cache_requests_total", "Number of issuer lookups by result (hit or miss).", "counter", func(srv *Server) metricVec { return &srv.metrics.issuerCache }},
+	{"sunglasses_db_commit_duration_seconds", "Latency of database commits during indexing.", "histogram", func(srv *Server) metricVec { return &srv.metrics.commitDuration }},
+	{"sunglasses_alerts_total", "Number of alerts raised about log misbehavior, by type.", "counter", func(srv *Server) metricVec { return &srv.metrics.alerts }},
+	{"sunglasses_upstream_integrity_errors_total", "Number of entries from the log which did not match the Merkle tree.", "counter", func(srv *Server) metricVec { return &srv.metrics.integrityErrors }},
+}
+
+// writeMetrics writes the metrics of servers, labelling each server's samples
+// with its monitoring prefix if labelLogs is true
+func writeMetrics(w http.ResponseWriter, servers []*Server, labelLogs bool) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	for _, family := range metricFamilies {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.typ)
+		for _, srv := range servers {
+			var extra labels
+			if labelLogs {
+				extra = labels{"log", srv.monitoringPrefix.String()}
+			}
+			family.vec(srv).write(w, family.name, extra)
+		}
+	}
+}
+
+func (srv *Server) getMetrics(w http.ResponseWriter, req *http.Request) {
+	writeMetrics(w, []*Server{srv}, false)
+}
+
+// MetricsHandler returns a handler which exports the metrics of all the
+// given servers, with a log label containing each server's monitoring prefix.
+func MetricsHandler(servers []*Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeMetrics(w, servers, true)
+	})
+}
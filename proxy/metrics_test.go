@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLabelsString(t *testing.T) {
+	tests := []struct {
+		labels labels
+		want   string
+	}{
+		{nil, ``},
+		{labels{"code", "200"}, `{code="200"}`},
+		{labels{"log", "https://example.com/log/", "code", "404"}, `{log="https://example.com/log/",code="404"}`},
+		{labels{"log", `a\b"c` + "\nd"}, `{log="a\\b\"c\nd"}`},
+		{labels{"log", "café\x01"}, "{log=\"café\x01\"}"},
+	}
+	for _, test := range tests {
+		if got := test.labels.String(); got != test.want {
+			t.Errorf("labels%q.String() = %s, want %s", []string(test.labels), got, test.want)
+		}
+	}
+}
+
+func TestIndexedTreeSizeMetric(t *testing.T) {
+	prefix, err := url.Parse("https://example.com/log/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(&Config{LogID: LogID{1}, SubmissionPrefix: prefix, MonitoringPrefix: prefix, Storage: NewMemoryStorage()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.indexedSize.Store(300)
+	srv.sth.Store(&signedTreeHead{TreeSize: 1000})
+	rec := httptest.NewRecorder()
+	writeMetrics(rec, []*Server{srv}, false)
+	body := rec.Body.String()
+	for _, want := range []string{"\nsunglasses_indexed_tree_size 300\n", "\nsunglasses_tree_size 1000\n"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, body)
+		}
+	}
+}
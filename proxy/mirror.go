@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"golang.org/x/mod/sumdb/tlog"
+	"golang.org/x/sync/errgroup"
+)
+
+// mirrorTiles downloads and stores every tile and issuer needed to serve sth
+// without contacting the log
+func (srv *Server) mirrorTiles(ctx context.Context, sth *signedTreeHead) error {
+	mirrorSize, err := srv.tiles.LoadMirrorSize(ctx)
+	if err != nil {
+		return err
+	}
+	if mirrorSize >= sth.TreeSize {
+		return nil
+	}
+
+	srv.log.Printf("Mirroring tiles for entries in range [%d, %d)...", mirrorSize, sth.TreeSize)
+	hashReader := tlog.TileHashReader(sth.tlogTree(), &tileReader{ctx: ctx, srv: srv})
+	chunkSize := uint64(srv.indexWorkers) * entriesPerTile
+	for size := mirrorSize; size < sth.TreeSize; {
+		next := min(sth.TreeSize, (size/chunkSize+1)*chunkSize)
+		if err := srv.mirrorChunk(ctx, sth, hashReader, size, next); err != nil {
+			return err
+		}
+		size = next
+	}
+
+	if err := srv.tiles.StoreMirrorSize(ctx, sth.TreeSize); err != nil {
+		return err
+	}
+	srv.log.Printf("Mirrored tiles up to tree size %d", sth.TreeSize)
+	return nil
+}
+
+// mirrorChunk mirrors the tiles which change when sth's tree grows from oldSize to newSize
+func (srv *Server) mirrorChunk(ctx context.Context, sth *signedTreeHead, hashReader tlog.HashReader, oldSize, newSize uint64) error {
+	var indexes []int64
+	var dataTiles []tlog.Tile
+	for _, tile := range tlog.NewTiles(tileHeight, int64(oldSize), int64(newSize)) {
+		if !isFullTile(tile) && newSize != sth.TreeSize {
+			// the log only serves partial tiles for the sizes of its checkpoints
+			continue
+		}
+		indexes = append(indexes, tlog.StoredHashIndex(tile.L*tileHeight, tile.N<<tileHeight))
+		if tile.L == 0 {
+			dataTiles = append(dataTiles, tlog.Tile{H: tileHeight, L: -1, N: tile.N, W: tile.W})
+		}
+	}
+
+	// Reading a hash from each tile causes the tile to be downloaded,
+	// verified against sth, and stored by tileReader.SaveTiles
+	if _, err := hashReader.ReadHashes(indexes); err != nil {
+		return logContactError{fmt.Errorf("error mirroring hash tiles: %w", err)}
+	}
+
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(srv.indexWorkers)
+	for _, tile := range dataTiles {
+		group.Go(func() error {
+			return srv.mirrorDataTile(ctx, tile)
+		})
+	}
+	return group.Wait()
+}
+
+// mirrorDataTile downloads the given data tile, verifies it against the
+// corresponding level 0 tile (which must already be mirrored), and stores it
+// along with the issuers of its entries
+func (srv *Server) mirrorDataTile(ctx context.Context, tile tlog.Tile) error {
+	if _, ok, err := srv.loadTile(ctx, tile); err != nil {
+		return err
+	} else if ok {
+		return nil
+	}
+	hashTile := tile
+	hashTile.L = 0
+	hashes, ok, err := srv.loadTile(ctx, hashTile)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("tile %s has not been mirrored", hashTile.Path())
+	}
+
+	data, err := srv.downloadRetry(ctx, srv.monitoringPrefix.JoinPath(formatTilePath("data", uint64(tile.N), uint64(tile.W))).String())
+	if err != nil {
+		return logContactError{fmt.Errorf("error downloading data tile %d: %w", tile.N, err)}
+	}
+
+	issuers, err := verifyDataTile(tile, data, hashes)
+	if err != nil {
+		return err
+	}
+	for fingerprint := range issuers {
+		if _, err := srv.getIssuer(ctx, fingerprint); err != nil {
+			return logContactError{fmt.Errorf("error mirroring issuer %x: %w", fingerprint, err)}
+		}
+	}
+	return srv.storeTile(ctx, tile, data)
+}
+
+// verifyDataTile checks that the entries in the given data tile match the
+// leaf hashes in the corresponding level 0 tile, and returns the fingerprints
+// of the entries' issuers
+func verifyDataTile(tile tlog.Tile, data []byte, hashes []byte) (map[[32]byte]struct{}, error) {
+	issuers := make(map[[32]byte]struct{})
+	for i := range tile.W {
+		var e entry
+		leafIndex := uint64(tile.N)*entriesPerTile + uint64(i)
+		if rest, err := e.parse(data, leafIndex); err != nil {
+			return nil, &integrityError{fmt.Errorf("error parsing entry %d: %w", leafIndex, err)}
+		} else {
+			data = rest
+		}
+		if leafHash := tlog.RecordHash(e.leafInput()); !bytes.Equal(leafHash[:], hashes[i*merkleHashLen:(i+1)*merkleHashLen]) {
+			return nil, &integrityError{fmt.Errorf("entry %d has leaf hash %x, but level 0 tile contains %x", leafIndex, leafHash[:], hashes[i*merkleHashLen:(i+1)*merkleHashLen])}
+		}
+		for _, fingerprint := range e.chain {
+			issuers[fingerprint] = struct{}{}
+		}
+	}
+	return issuers, nil
+}
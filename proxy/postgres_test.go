@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestPostgresStorage runs the migrations and indexes a log using the
+// PostgreSQL database at $SUNGLASSES_TEST_POSTGRES (a postgres:// URL), in a
+// schema which is dropped afterwards
+func TestPostgresStorage(t *testing.T) {
+	dsn := os.Getenv("SUNGLASSES_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("SUNGLASSES_TEST_POSTGRES is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	schemaName := fmt.Sprintf("sunglasses_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec(`CREATE SCHEMA ` + schemaName); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec(`DROP SCHEMA ` + schemaName + ` CASCADE`)
+
+	schemaDSN, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := schemaDSN.Query()
+	query.Set("search_path", schemaName)
+	schemaDSN.RawQuery = query.Encode()
+	storage, err := OpenSQLStorage(schemaDSN.String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	testSQLStorage(t, storage)
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	testSQLStorage(t, openTestSQLStorage(t))
+}
+
+// testSQLStorage runs one tick of a server using storage, and checks that
+// the data it stores, and that of the optional storage interfaces, can be
+// read back
+func testSQLStorage(t *testing.T, storage *SQLStorage) {
+	ctx := context.Background()
+	log := newFakeLog(t, 300)
+	upstream := httptest.NewServer(log)
+	defer upstream.Close()
+	prefix, err := url.Parse(upstream.URL + "/log/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.origin = originFromSubmissionPrefix(prefix)
+
+	srv, err := NewServer(&Config{
+		LogID:            log.logID,
+		SubmissionPrefix: prefix,
+		MonitoringPrefix: prefix,
+		Storage:          storage,
+		LocalProofs:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if size := srv.indexedSize.Load(); size != 300 {
+		t.Errorf("indexed %d leaves", size)
+	}
+	leafHash := log.hashes[0]
+	if position, found, err := storage.LookupLeaf(ctx, leafHash[:]); err != nil {
+		t.Fatal(err)
+	} else if !found || position != 0 {
+		t.Errorf("leaf 0 was found=%v at position %d", found, position)
+	}
+	if size, err := storage.LoadProofSize(ctx); err != nil {
+		t.Fatal(err)
+	} else if size != 300 {
+		t.Errorf("hash tiles were computed up to tree size %d", size)
+	}
+	if record, err := storage.LoadLatestSTHRecord(ctx); err != nil {
+		t.Fatal(err)
+	} else if record == nil || record.TreeSize != 300 {
+		t.Errorf("STH history wasn't recorded: %+v", record)
+	}
+	if contactTime, err := storage.LoadContactTime(ctx); err != nil {
+		t.Fatal(err)
+	} else if contactTime.IsZero() {
+		t.Error("contact time wasn't stored")
+	}
+
+	// the indexes, which the fake log can't populate since it has no data tiles
+	position, err := storage.LoadPosition(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certHash := sha256.Sum256([]byte("certificate"))
+	if err := storage.PutCertHashes(ctx, 5, [][32]byte{certHash}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.PutDNSNames(ctx, 5, [][]string{{"www.example.com", "example.com"}, {"example.org"}, {"www.example.com"}, {"example.community"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Commit(ctx, position); err != nil {
+		t.Fatal(err)
+	}
+	if position, found, err := storage.LookupCert(ctx, certHash[:]); err != nil {
+		t.Fatal(err)
+	} else if !found || position != 5 {
+		t.Errorf("certificate was found=%v at position %d", found, position)
+	}
+	if positions, err := storage.SearchDNSName(ctx, "example.com", true, 0, 300, 10); err != nil {
+		t.Fatal(err)
+	} else if !slices.Equal(positions, []uint64{5, 7}) {
+		t.Errorf("subdomain search returned %v", positions)
+	}
+	if positions, err := storage.SearchDNSName(ctx, "example.com", false, 0, 300, 10); err != nil {
+		t.Fatal(err)
+	} else if !slices.Equal(positions, []uint64{5}) {
+		t.Errorf("exact search returned %v", positions)
+	}
+
+	submission := &Submission{LeafIndex: 400, CertSHA256: certHash[:], Timestamp: log.timestamp}
+	if err := storage.PutSubmission(ctx, submission); err != nil {
+		t.Fatal(err)
+	}
+	if due, err := storage.LoadDueSubmissions(ctx, 300, log.timestamp, time.Hour); err != nil {
+		t.Fatal(err)
+	} else if len(due) != 0 {
+		t.Errorf("submission is due before the MMD has elapsed: %+v", due)
+	}
+	if due, err := storage.LoadDueSubmissions(ctx, 401, log.timestamp, time.Hour); err != nil {
+		t.Fatal(err)
+	} else if len(due) != 1 || due[0].LeafIndex != 400 {
+		t.Errorf("submission isn't due once incorporated: %+v", due)
+	}
+}
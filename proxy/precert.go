@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/cryptobyte"
+	cryptobyte_asn1 "golang.org/x/crypto/cryptobyte/asn1"
+	"io"
+	"net/http"
+	"slices"
+)
+
+var (
+	oidSCTList                = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+	oidPoison                 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+	oidPrecertSigning         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 4}
+	oidAuthorityKeyIdentifier = asn1.ObjectIdentifier{2, 5, 29, 35}
+)
+
+// precertTBSHash returns the hash which the precertificate index uses for
+// the given final certificate: the SHA-256 of its TBSCertificate with the
+// SCT list extension removed, which is identical to the tbs_certificate
+// of the corresponding precertificate entry
+func precertTBSHash(certDER []byte) ([32]byte, error) {
+	tbs, err := reconstructPrecertTBS(certDER)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(tbs), nil
+}
+
+func reconstructPrecertTBS(certDER []byte) ([]byte, error) {
+	return rewriteTBS(certDER, oidSCTList, nil)
+}
+
+// precertSignedEntry returns the PreCert structure which the log signs for
+// the chain submitted to add-pre-chain, as described in RFC 6962 section 3.2
+func precertSignedEntry(chain [][]byte) ([]byte, error) {
+	if len(chain) < 2 {
+		return nil, errors.New("chain does not contain issuer")
+	}
+	issuer, err := x509.ParseCertificate(chain[1])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing issuer: %w", err)
+	}
+	var preIssuer *x509.Certificate
+	if slices.ContainsFunc(issuer.UnknownExtKeyUsage, oidPrecertSigning.Equal) {
+		if len(chain) < 3 {
+			return nil, errors.New("chain does not contain issuer of precertificate signing certificate")
+		}
+		preIssuer = issuer
+		if issuer, err = x509.ParseCertificate(chain[2]); err != nil {
+			return nil, fmt.Errorf("error parsing issuer of precertificate signing certificate: %w", err)
+		}
+	}
+	tbs, err := rewriteTBS(chain[0], oidPoison, preIssuer)
+	if err != nil {
+		return nil, err
+	}
+	issuerKeyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	b := cryptobyte.NewBuilder(issuerKeyHash[:])
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(tbs)
+	})
+	return b.Bytes()
+}
+
+// rewriteTBS returns certDER's TBSCertificate with the extension identified
+// by remove omitted.  If preIssuer is non-nil, the issuer and authority key
+// identifier are replaced with those of the precertificate signing
+// certificate preIssuer, as described in RFC 6962 section 3.1.  (If preIssuer
+// has no authority key identifier, it's omitted, since it must match the
+// final issuer.)
+func rewriteTBS(certDER []byte, remove asn1.ObjectIdentifier, preIssuer *x509.Certificate) ([]byte, error) {
+	var cert, tbs cryptobyte.String
+	input := cryptobyte.String(certDER)
+	if !input.ReadASN1(&cert, cryptobyte_asn1.SEQUENCE) || !cert.ReadASN1(&tbs, cryptobyte_asn1.SEQUENCE) {
+		return nil, errors.New("malformed certificate")
+	}
+
+	var preIssuerAKI []byte
+	if preIssuer != nil {
+		for _, extension := range preIssuer.Extensions {
+			if extension.Id.Equal(oidAuthorityKeyIdentifier) {
+				if der, err := asn1.Marshal(extension); err != nil {
+					return nil, err
+				} else {
+					preIssuerAKI = der
+				}
+			}
+		}
+	}
+
+	extensionsTag := cryptobyte_asn1.Tag(3).Constructed().ContextSpecific()
+	sequences := 0
+	b := cryptobyte.NewBuilder(nil)
+	b.AddASN1(cryptobyte_asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		for !tbs.Empty() {
+			var element cryptobyte.String
+			var tag cryptobyte_asn1.Tag
+			if !tbs.ReadAnyASN1Element(&element, &tag) {
+				b.SetError(errors.New("malformed TBSCertificate"))
+				return
+			}
+			if tag == cryptobyte_asn1.SEQUENCE {
+				// signature, issuer, validity, subject, subjectPublicKeyInfo
+				sequences++
+				if sequences == 2 && preIssuer != nil {
+					b.AddBytes(preIssuer.RawIssuer)
+					continue
+				}
+			}
+			if tag != extensionsTag {
+				b.AddBytes(element)
+				continue
+			}
+			var extensions cryptobyte.String
+			if !element.ReadASN1(&element, extensionsTag) || !element.ReadASN1(&extensions, cryptobyte_asn1.SEQUENCE) {
+				b.SetError(errors.New("malformed extensions"))
+				return
+			}
+			b.AddASN1(extensionsTag, func(b *cryptobyte.Builder) {
+				b.AddASN1(cryptobyte_asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					for !extensions.Empty() {
+						var extension cryptobyte.String
+						if !extensions.ReadASN1Element(&extension, cryptobyte_asn1.SEQUENCE) {
+							b.SetError(errors.New("malformed extension"))
+							return
+						}
+						contents := extension
+						var oid asn1.ObjectIdentifier
+						if !contents.ReadASN1(&contents, cryptobyte_asn1.SEQUENCE) || !contents.ReadASN1ObjectIdentifier(&oid) {
+							b.SetError(errors.New("malformed extension"))
+							return
+						}
+						if oid.Equal(remove) {
+							continue
+						} else if preIssuer != nil && oid.Equal(oidAuthorityKeyIdentifier) {
+							if preIssuerAKI != nil {
+								b.AddBytes(preIssuerAKI)
+							}
+						} else {
+							b.AddBytes(extension)
+						}
+					}
+				})
+			})
+		}
+	})
+	return b.Bytes()
+}
+
+// lookupPrecertByCert finds the precertificate entry for the final
+// certificate (DER or PEM) in the request body
+func (srv *Server) lookupPrecertByCert(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if block, _ := pem.Decode(body); block != nil {
+		body = block.Bytes
+	}
+	tbsHash, err := precertTBSHash(body)
+	if err != nil {
+		http.Error(w, "Invalid certificate: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !srv.precertIndex {
+		http.Error(w, "This log does not have a precertificate index", http.StatusNotImplemented)
+		return
+	}
+	sth := srv.sth.Load()
+	if sth == nil {
+		http.Error(w, "not yet synchronized with upstream log", http.StatusServiceUnavailable)
+		return
+	}
+	indexedSize := srv.indexedSize.Load()
+	leafIndex, found, err := srv.indexes.LookupPrecert(req.Context(), tbsHash[:])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !found {
+		notFound(w, "precertificate", "precertificate index", srv.precertIndexStart.Load(), indexedSize, sth.TreeSize)
+		return
+	}
+	srv.writeLookupResponse(w, req, sth, leafIndex)
+}
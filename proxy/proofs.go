@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/mod/sumdb/tlog"
+	"slices"
+	"strings"
+)
+
+// Local proof computation: the indexer stores the level 0 tiles which it
+// downloads as pending tiles, and buildHashTiles computes the higher-level
+// tiles from them and stores them all once they have been verified against
+// the STH, so that hashReader can serve proofs without contacting the log.
+//
+// Tiles are verified by computing the tree hash from them and checking it
+// against the STH, rather than with tlog.TileHashReader, which doesn't check
+// every full tile against its parent when some of the tiles needed for the
+// tree hash are shared.
+
+// buildHashTiles computes, verifies, and stores the hash tiles for sth's tree
+// which aren't already stored.  It works through the tree in chunks, like
+// mirrorTiles, advancing proofSize after each one, so that it needs a bounded
+// amount of memory and resumes where it left off.
+func (srv *Server) buildHashTiles(ctx context.Context, sth *signedTreeHead) error {
+	proofSize := srv.proofSize.Load()
+	if !srv.localProofs || proofSize >= sth.TreeSize {
+		return nil
+	}
+
+	chunkSize := uint64(srv.indexWorkers) * entriesPerTile
+	if sth.TreeSize-proofSize > chunkSize {
+		srv.log.Printf("Computing hash tiles for entries in range [%d, %d)...", proofSize, sth.TreeSize)
+	}
+	for size := proofSize; size < sth.TreeSize; {
+		next := min(sth.TreeSize, (size/chunkSize+1)*chunkSize)
+		if err := srv.buildHashTilesChunk(ctx, sth, size, next); err != nil {
+			return err
+		}
+		if err := srv.tiles.StoreProofSize(ctx, next); err != nil {
+			return err
+		}
+		srv.proofSize.Store(next)
+		size = next
+	}
+	return nil
+}
+
+// buildHashTilesChunk builds the tiles which change when sth's tree grows
+// from oldSize to newSize, verifying them by checking that the tree hash for
+// newSize is consistent with sth
+func (srv *Server) buildHashTilesChunk(ctx context.Context, sth *signedTreeHead, oldSize, newSize uint64) error {
+	unverified := make(map[tlog.Tile][]byte)
+	pending := make(map[tlog.Tile]bool)
+	var missing, higher []tlog.Tile
+	for _, tile := range tlog.NewTiles(tileHeight, int64(oldSize), int64(newSize)) {
+		if tile.L > 0 {
+			// computed even if already stored (e.g. because it was
+			// downloaded for a proof), so that the tree hash covers
+			// the level 0 tiles
+			higher = append(higher, tile)
+		} else if _, ok, err := srv.loadTile(ctx, tile); err != nil {
+			return err
+		} else if ok {
+			if err := srv.tiles.DeletePendingTile(ctx, tile); err != nil {
+				return err
+			}
+		} else if data, ok, err := srv.tiles.LoadPendingTile(ctx, tile); err != nil {
+			return err
+		} else if ok {
+			unverified[tile] = data[:tile.W*merkleHashLen]
+			pending[tile] = true
+		} else {
+			missing = append(missing, tile)
+		}
+	}
+	if len(missing) > 0 {
+		// These weren't stored by the indexer (e.g. because the log was
+		// indexed before local proofs were enabled, or they didn't match
+		// the STH), so download them
+		srv.log.Printf("Downloading %d level 0 tiles which are missing from storage", len(missing))
+		data, err := (&tileReader{ctx: ctx, srv: srv}).ReadTiles(missing)
+		if err != nil {
+			return logContactError{fmt.Errorf("error downloading level 0 tiles: %w", err)}
+		}
+		for i, tile := range missing {
+			unverified[tile] = data[i]
+		}
+	}
+	// tlog.NewTiles returns each level's tiles after the level below
+	for _, tile := range higher {
+		data, err := srv.computeHashTile(ctx, tile, unverified)
+		if err != nil {
+			return err
+		}
+		unverified[tile] = data
+	}
+
+	treeHash, err := tlog.TreeHash(int64(newSize), srv.unverifiedHashReader(ctx, newSize, unverified))
+	if err != nil {
+		return err
+	}
+	if newSize == sth.TreeSize {
+		if treeHash != sth.tlogTree().Hash {
+			return srv.discardPendingTiles(ctx, sth, newSize, unverified, pending)
+		}
+	} else {
+		proof, err := tlog.ProveTree(int64(sth.TreeSize), int64(newSize), tlog.TileHashReader(sth.tlogTree(), &tileReader{ctx: ctx, srv: srv}))
+		if err != nil {
+			return logContactError{fmt.Errorf("error reading consistency proof for tree size %d: %w", newSize, err)}
+		}
+		if tlog.CheckTree(proof, int64(sth.TreeSize), sth.tlogTree().Hash, int64(newSize), treeHash) != nil {
+			return srv.discardPendingTiles(ctx, sth, newSize, unverified, pending)
+		}
+	}
+
+	for tile, data := range unverified {
+		if pending[tile] {
+			if err := srv.tiles.DeletePendingTile(ctx, tile); err != nil {
+				return err
+			}
+		}
+		if err := srv.storeTile(ctx, tile, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unverifiedHashReader returns a HashReader for the tree of the given size
+// which reads hashes from the tiles in unverified or in storage, without
+// verifying them
+func (srv *Server) unverifiedHashReader(ctx context.Context, treeSize uint64, unverified map[tlog.Tile][]byte) tlog.HashReader {
+	return tlog.HashReaderFunc(func(indexes []int64) ([]tlog.Hash, error) {
+		hashes := make([]tlog.Hash, len(indexes))
+		for i, index := range indexes {
+			tile := tlog.TileForIndex(tileHeight, index)
+			tile.W = int(min(entriesPerTile, treeSize>>(tile.L*tileHeight)-uint64(tile.N)*entriesPerTile))
+			data, ok := unverified[tile]
+			if !ok {
+				var err error
+				if data, ok, err = srv.loadTile(ctx, tile); err != nil {
+					return nil, err
+				} else if !ok {
+					return nil, fmt.Errorf("tile %s is missing from storage", tile.Path())
+				}
+			}
+			hash, err := tlog.HashFromTile(tile, data, index)
+			if err != nil {
+				return nil, err
+			}
+			hashes[i] = hash
+		}
+		return hashes, nil
+	})
+}
+
+// discardPendingTiles is called when the tiles built for newSize aren't
+// consistent with sth.  It checks each of the full pending tiles on its own
+// and stores the ones which match sth, and deletes all the pending tiles, so
+// that only the tiles which may not match are downloaded again.  It raises
+// an alert and returns an integrityError.
+func (srv *Server) discardPendingTiles(ctx context.Context, sth *signedTreeHead, newSize uint64, unverified map[tlog.Tile][]byte, pending map[tlog.Tile]bool) error {
+	var mismatched []string
+	for tile := range pending {
+		data := unverified[tile]
+		if !isFullTile(tile) {
+			// can't be checked on its own, but it's only one tile
+			mismatched = append(mismatched, tile.Path())
+		} else if ok, err := srv.checkLeafTile(ctx, sth, tile, data); err != nil {
+			return err
+		} else if !ok {
+			mismatched = append(mismatched, tile.Path())
+		} else if err := srv.storeTile(ctx, tile, data); err != nil {
+			return err
+		}
+		if err := srv.tiles.DeletePendingTile(ctx, tile); err != nil {
+			return err
+		}
+	}
+	slices.Sort(mismatched)
+	err := fmt.Errorf("hash tiles built for tree size %d from the level 0 tiles downloaded while indexing don't match the STH for tree size %d (discarded %s)", newSize, sth.TreeSize, strings.Join(mismatched, ", "))
+	srv.raiseAlert(ctx, &Alert{Type: "root_mismatch", Message: err.Error(), Checkpoint: string(sth.checkpoint)})
+	return &integrityError{err}
+}
+
+// checkLeafTile reports whether the given full level 0 tile is in sth's tree,
+// using an inclusion proof for its first leaf in which the hashes within the
+// tile are computed from data, and the rest are read from the log's tiles
+func (srv *Server) checkLeafTile(ctx context.Context, sth *signedTreeHead, tile tlog.Tile, data []byte) (bool, error) {
+	logHashReader := tlog.TileHashReader(sth.tlogTree(), &tileReader{ctx: ctx, srv: srv})
+	hashReader := tlog.HashReaderFunc(func(indexes []int64) ([]tlog.Hash, error) {
+		hashes := make([]tlog.Hash, len(indexes))
+		var logIndexes []int64
+		var logPositions []int
+		for i, index := range indexes {
+			if t := tlog.TileForIndex(tileHeight, index); t.L == tile.L && t.N == tile.N {
+				hash, err := tlog.HashFromTile(tile, data, index)
+				if err != nil {
+					return nil, err
+				}
+				hashes[i] = hash
+			} else {
+				logIndexes = append(logIndexes, index)
+				logPositions = append(logPositions, i)
+			}
+		}
+		if len(logIndexes) > 0 {
+			logHashes, err := logHashReader.ReadHashes(logIndexes)
+			if err != nil {
+				return nil, err
+			}
+			for j, i := range logPositions {
+				hashes[i] = logHashes[j]
+			}
+		}
+		return hashes, nil
+	})
+	leafIndex := tile.N * entriesPerTile
+	proof, err := tlog.ProveRecord(int64(sth.TreeSize), leafIndex, hashReader)
+	if err != nil {
+		return false, logContactError{fmt.Errorf("error reading inclusion proof for leaf %d: %w", leafIndex, err)}
+	}
+	return tlog.CheckRecord(proof, int64(sth.TreeSize), sth.tlogTree().Hash, leafIndex, tlog.Hash(data[:merkleHashLen])) == nil, nil
+}
+
+// computeHashTile computes the given hash tile (which must be above level 0)
+// from the roots of the full tiles one level below it, which are either in
+// unverified or stored
+func (srv *Server) computeHashTile(ctx context.Context, tile tlog.Tile, unverified map[tlog.Tile][]byte) ([]byte, error) {
+	data := make([]byte, 0, tile.W*merkleHashLen)
+	for i := range int64(tile.W) {
+		child := tlog.Tile{H: tileHeight, L: tile.L - 1, N: tile.N<<tileHeight + i, W: entriesPerTile}
+		childData, ok := unverified[child]
+		if !ok {
+			var err error
+			if childData, ok, err = srv.loadTile(ctx, child); err != nil {
+				return nil, err
+			} else if !ok {
+				return nil, fmt.Errorf("tile %s is missing from storage", child.Path())
+			}
+		}
+		root := tileRoot(childData)
+		data = append(data, root[:]...)
+	}
+	return data, nil
+}
+
+// tileRoot returns the root hash of the subtree formed by the hashes in a full tile
+func tileRoot(data []byte) tlog.Hash {
+	hashes := make([]tlog.Hash, len(data)/merkleHashLen)
+	for i := range hashes {
+		hashes[i] = tlog.Hash(data[i*merkleHashLen : (i+1)*merkleHashLen])
+	}
+	for len(hashes) > 1 {
+		for i := range len(hashes) / 2 {
+			hashes[i] = tlog.NodeHash(hashes[2*i], hashes[2*i+1])
+		}
+		hashes = hashes[:len(hashes)/2]
+	}
+	return hashes[0]
+}
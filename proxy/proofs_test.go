@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// newLocalProofsServer returns a Server with local proofs which has indexed
+// log, using a SQLite database
+func newLocalProofsServer(t *testing.T, log *fakeLog, alerts AlertSink) (*Server, *SQLStorage) {
+	upstream := httptest.NewServer(log)
+	t.Cleanup(upstream.Close)
+	prefix, err := url.Parse(upstream.URL + "/log/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.origin = originFromSubmissionPrefix(prefix)
+	storage := openTestSQLStorage(t)
+	srv, err := NewServer(&Config{
+		LogID:            log.logID,
+		SubmissionPrefix: prefix,
+		MonitoringPrefix: prefix,
+		Storage:          storage,
+		LocalProofs:      true,
+		AlertSinks:       []AlertSink{alerts},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.tick(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return srv, storage
+}
+
+// putPendingTiles adds tiles to the pending tiles as if the indexer had
+// downloaded them
+func putPendingTiles(t *testing.T, storage *SQLStorage, tiles map[tlog.Tile][]byte) {
+	ctx := context.Background()
+	position, err := storage.LoadPosition(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tile, data := range tiles {
+		if err := storage.PutPendingTile(ctx, tile, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Commit(ctx, position); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkStoredTiles checks that the tiles which change when log grows from
+// oldSize to newSize are stored with the log's contents, and aren't pending
+func checkStoredTiles(t *testing.T, srv *Server, storage *SQLStorage, log *fakeLog, oldSize, newSize int64) {
+	ctx := context.Background()
+	for _, tile := range tlog.NewTiles(tileHeight, oldSize, newSize) {
+		want, err := tlog.ReadTileData(tile, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, found, err := srv.loadTile(ctx, tile); err != nil {
+			t.Fatal(err)
+		} else if !found || !bytes.Equal(data, want) {
+			t.Errorf("tile %s wasn't stored correctly", tile.Path())
+		}
+		if _, found, err := storage.LoadPendingTile(ctx, tile); err != nil {
+			t.Fatal(err)
+		} else if found {
+			t.Errorf("tile %s is still pending", tile.Path())
+		}
+	}
+}
+
+func TestPendingTilesAreVerified(t *testing.T) {
+	ctx := context.Background()
+	log := newFakeLog(t, 300)
+	alerts := new(testAlertSink)
+	srv, storage := newLocalProofsServer(t, log, alerts)
+	if size := srv.proofSize.Load(); size != 300 {
+		t.Fatalf("hash tiles were computed up to tree size %d", size)
+	}
+
+	// As if the indexer had downloaded level 0 tiles for tree size 1000,
+	// in which a hash that was indexed for tree size 300 was changed.
+	// Indexing only the new leaves, it wouldn't notice.
+	log.grow(t, 1000)
+	log.timestamp++
+	sth, err := srv.downloadSTH(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tile1 := tlog.Tile{H: tileHeight, L: 0, N: 1, W: entriesPerTile}
+	tile2 := tlog.Tile{H: tileHeight, L: 0, N: 2, W: entriesPerTile}
+	tile3 := tlog.Tile{H: tileHeight, L: 0, N: 3, W: 232}
+	good := make(map[tlog.Tile][]byte)
+	for _, tile := range []tlog.Tile{tile1, tile2, tile3} {
+		if good[tile], err = tlog.ReadTileData(tile, log); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bad1 := bytes.Clone(good[tile1])
+	bad1[0] ^= 1
+	putPendingTiles(t, storage, map[tlog.Tile][]byte{tile1: bad1, tile2: good[tile2], tile3: good[tile3]})
+
+	if err := srv.buildHashTiles(ctx, sth); !errors.As(err, new(*integrityError)) {
+		t.Fatalf("buildHashTiles didn't fail with an integrity error: %v", err)
+	}
+	srv.pendingAlerts.Wait()
+	if len(alerts.types) != 1 || alerts.types[0] != "root_mismatch" {
+		t.Errorf("expected a root_mismatch alert, not %v", alerts.types)
+	}
+	if size := srv.proofSize.Load(); size != 300 {
+		t.Errorf("proof size was advanced to %d", size)
+	}
+	// only the tile which doesn't match is discarded
+	if _, found, err := storage.LoadTile(ctx, tile1); err != nil {
+		t.Fatal(err)
+	} else if found {
+		t.Errorf("tile %s was stored", tile1.Path())
+	}
+	if data, found, err := storage.LoadTile(ctx, tile2); err != nil {
+		t.Fatal(err)
+	} else if !found || !bytes.Equal(data, good[tile2]) {
+		t.Errorf("tile %s wasn't stored", tile2.Path())
+	}
+	for _, tile := range []tlog.Tile{tile1, tile2, tile3} {
+		if _, found, err := storage.LoadPendingTile(ctx, tile); err != nil {
+			t.Fatal(err)
+		} else if found {
+			t.Errorf("pending tile %s wasn't discarded", tile.Path())
+		}
+	}
+
+	// the discarded tiles are downloaded instead
+	if err := srv.buildHashTiles(ctx, sth); err != nil {
+		t.Fatalf("buildHashTiles failed: %s", err)
+	}
+	if size := srv.proofSize.Load(); size != 1000 {
+		t.Errorf("proof size is %d, not 1000", size)
+	}
+	checkStoredTiles(t, srv, storage, log, 300, 1000)
+
+	// the tiles which the indexer stores are verified and promoted
+	log.grow(t, 1500)
+	log.timestamp++
+	if err := srv.tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if size := srv.proofSize.Load(); size != 1500 {
+		t.Errorf("proof size is %d, not 1500", size)
+	}
+	checkStoredTiles(t, srv, storage, log, 1000, 1500)
+}
+
+func TestHashTilesBuiltInChunks(t *testing.T) {
+	ctx := context.Background()
+	log := newFakeLog(t, 300)
+	alerts := new(testAlertSink)
+	srv, storage := newLocalProofsServer(t, log, alerts)
+	srv.indexWorkers = 1 // chunks of one level 0 tile
+
+	log.grow(t, 1000)
+	log.timestamp++
+	sth, err := srv.downloadSTH(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := make(map[tlog.Tile][]byte)
+	for _, tile := range tlog.NewTiles(tileHeight, 300, 1000) {
+		if tile.L == 0 {
+			if pending[tile], err = tlog.ReadTileData(tile, log); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	tile2 := tlog.Tile{H: tileHeight, L: 0, N: 2, W: entriesPerTile}
+	pending[tile2] = bytes.Clone(pending[tile2])
+	pending[tile2][0] ^= 1
+	putPendingTiles(t, storage, pending)
+
+	// the chunks before the tile which doesn't match are kept
+	if err := srv.buildHashTiles(ctx, sth); !errors.As(err, new(*integrityError)) {
+		t.Fatalf("buildHashTiles didn't fail with an integrity error: %v", err)
+	}
+	if size := srv.proofSize.Load(); size != 512 {
+		t.Errorf("proof size is %d, not 512", size)
+	}
+	if size, err := storage.LoadProofSize(ctx); err != nil {
+		t.Fatal(err)
+	} else if size != 512 {
+		t.Errorf("stored proof size is %d, not 512", size)
+	}
+	checkStoredTiles(t, srv, storage, log, 300, 512)
+
+	if err := srv.buildHashTiles(ctx, sth); err != nil {
+		t.Fatalf("buildHashTiles failed: %s", err)
+	}
+	if size := srv.proofSize.Load(); size != 1000 {
+		t.Errorf("proof size is %d, not 1000", size)
+	}
+	checkStoredTiles(t, srv, storage, log, 300, 1000)
+
+	// proofs are served from the stored tiles
+	log.noPartial = true
+	log.grow(t, 2000)
+	if _, err := tlog.ProveRecord(1000, 700, srv.hashReader(ctx, sth)); err != nil {
+		t.Errorf("error proving record from stored tiles: %s", err)
+	}
+}
+
+func TestLeafTileCappedAtTreeSize(t *testing.T) {
+	ctx := context.Background()
+	log := newFakeLog(t, 300)
+	srv, _ := newLocalProofsServer(t, log, new(testAlertSink))
+	sth := srv.sth.Load()
+
+	// the log has grown since sth, and no longer serves partial tile 1
+	log.grow(t, 600)
+	log.noPartial = true
+	results := make(chan leafHashes, 1)
+	if err := srv.downloadLeafHashes(ctx, sth, 1, 0, 44, results); err != nil {
+		t.Fatal(err)
+	}
+	result := <-results
+	if result.tile.W != 44 || len(result.tileData) != 44*merkleHashLen {
+		t.Errorf("level 0 tile has width %d and %d bytes, instead of being truncated to tree size 300", result.tile.W, len(result.tileData))
+	}
+}
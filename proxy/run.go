@@ -1,12 +1,14 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
-	"database/sql"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"golang.org/x/mod/sumdb/tlog"
 	"golang.org/x/sync/errgroup"
-	"log"
 	"software.sslmate.com/src/certspotter/merkletree"
 	"time"
 )
@@ -24,148 +26,216 @@ func isLogContactError(e error) bool {
 	return ok
 }
 
-func (srv *Server) Run() error {
-	ticker := time.NewTicker(time.Minute)
+// Run indexes the log until ctx is done, at which point it commits any
+// in-progress indexing, waits for alerts to be sent, and returns nil.  In
+// frontend mode, Run instead reloads the state stored in the database by the
+// indexing instance.
+func (srv *Server) Run(ctx context.Context) error {
+	defer srv.pendingAlerts.Wait()
+	if srv.frontend {
+		return srv.runFrontend(ctx)
+	}
+	ticker := time.NewTicker(srv.pollInterval)
 	defer ticker.Stop()
 	for {
-		if err := srv.tick(); isLogContactError(err) {
-			log.Printf("error contacting log (will try again later): %s", err)
+		if err := srv.tick(ctx); ctx.Err() != nil {
+			return nil
+		} else if isLogContactError(err) {
+			srv.log.Printf("error contacting log (will try again later): %s", err)
 		} else if err != nil {
 			return err
 		}
-		<-ticker.C
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
 	}
 }
 
 type leafHashes struct {
 	startIndex uint64
 	hashes     [][]byte
+	certHashes [][32]byte // SHA-256 of each entry's certificate or precertificate; nil unless certIndex
+	dnsNames   [][]string // DNS names in each entry's certificate or precertificate; nil unless dnsIndex
+	tbsHashes  [][]byte   // SHA-256 of each precertificate entry's TBSCertificate (nil for certificate entries); nil unless precertIndex
+	tile       tlog.Tile  // the level 0 tile containing the hashes; only set if localProofs
+	tileData   []byte
+}
+
+// loadSTH returns the stored STH, or nil if none
+func (srv *Server) loadSTH(ctx context.Context) (*signedTreeHead, error) {
+	sthBytes, err := srv.storage.LoadSTH(ctx)
+	if err != nil || sthBytes == nil {
+		return nil, err
+	}
+	var stored storedSTH
+	if err := json.Unmarshal(sthBytes, &stored); err != nil {
+		return nil, fmt.Errorf("stored STH is corrupted: %w", err)
+	}
+	sth := stored.signedTreeHead
+	sth.checkpoint = stored.Checkpoint
+	return &sth, nil
 }
 
-func (srv *Server) storeSTH(sth *signedTreeHead) error {
-	if sthBytes, err := json.Marshal(sth); err != nil {
+func (srv *Server) storeSTH(ctx context.Context, sth *signedTreeHead) error {
+	if sthBytes, err := json.Marshal(storedSTH{signedTreeHead: *sth, Checkpoint: sth.checkpoint}); err != nil {
 		return fmt.Errorf("error marshaling STH: %w", err)
-	} else if _, err := srv.db.Exec(`UPDATE state SET sth = $1`, sthBytes); err != nil {
-		return fmt.Errorf("error storing STH in database: %w", err)
+	} else if err := srv.storage.StoreSTH(ctx, sthBytes); err != nil {
+		return err
 	}
 	srv.sth.Store(sth)
 	return nil
 }
 
-func (srv *Server) loadPosition(position *merkletree.FragmentedCollapsedTree) error {
-	var positionBytes []byte
-	if err := srv.db.QueryRow(`SELECT position FROM state`).Scan(&positionBytes); err != nil {
-		return fmt.Errorf("error loading position from database: %w", err)
+func (srv *Server) loadPosition(ctx context.Context, position *merkletree.FragmentedCollapsedTree) error {
+	if positionBytes, err := srv.storage.LoadPosition(ctx); err != nil {
+		return err
 	} else if positionBytes == nil {
 		return nil
 	} else if err := json.Unmarshal(positionBytes, position); err != nil {
-		return fmt.Errorf("error unmarshaling position from database: %w", err)
+		return fmt.Errorf("error unmarshaling stored position: %w", err)
 	} else {
 		return nil
 	}
 }
 
-func (srv *Server) tick() error {
-	sth, err := srv.downloadSTH()
-	if err != nil {
+func (srv *Server) tick(ctx context.Context) error {
+	sth, err := srv.downloadSTH(ctx)
+	if originErr := (*originError)(nil); errors.As(err, &originErr) && srv.upstreamSTH.Load() == nil {
+		// the first checkpoint has the wrong origin, so the log is probably misconfigured
+		return err
+	} else if err != nil {
 		return logContactError{fmt.Errorf("error downloading latest checkpoint: %w", err)}
 	}
+	contactTime := time.Now()
+	srv.lastUpstreamContact.Store(contactTime.UnixNano())
+	if srv.storage != nil {
+		// lets frontends tell whether the state they reload is fresh
+		if err := srv.storage.StoreContactTime(ctx, contactTime); err != nil {
+			return err
+		}
+	}
+	if len(srv.witnesses) > 0 {
+		if err := srv.checkCosignatures(sth); err != nil {
+			srv.log.Printf("not accepting checkpoint for tree size %d: %s", sth.TreeSize, err)
+			if srv.witnessStallSince.CompareAndSwap(0, time.Now().UnixNano()) {
+				srv.raiseAlert(ctx, &Alert{Type: "witness_quorum", Message: fmt.Sprintf("checkpoint for tree size %d lacks a witness quorum: %s", sth.TreeSize, err), Checkpoint: string(sth.checkpoint)})
+			}
+			return nil
+		}
+		srv.witnessStallSince.Store(0)
+	}
+	if accepted, err := srv.acceptSTH(ctx, sth); err != nil {
+		return err
+	} else if !accepted {
+		return nil
+	}
+	srv.upstreamSTH.Store(sth)
 
-	if srv.db == nil {
+	if srv.storage == nil {
 		srv.sth.Store(sth)
 		return nil
-	} else if srv.disableLeafIndex {
-		return srv.storeSTH(sth)
+	}
+	if srv.mirror {
+		if err := srv.mirrorTiles(ctx, sth); err != nil {
+			return err
+		}
+	}
+	if srv.submissions != nil {
+		if err := srv.checkSubmissions(ctx, sth); err != nil {
+			srv.log.Printf("error checking submissions: %s", err)
+		}
+	}
+	if srv.disableLeafIndex {
+		return srv.storeSTH(ctx, sth)
+	} else if srv.serveUnindexedSTH {
+		if err := srv.storeSTH(ctx, sth); err != nil {
+			return err
+		}
 	}
 
 	var position merkletree.FragmentedCollapsedTree
-	if err := srv.loadPosition(&position); err != nil {
+	if err := srv.loadPosition(ctx, &position); err != nil {
 		return err
 	}
+	srv.indexedSize.Store(indexedPrefix(&position))
 
+	gaps := unindexedGaps(&position, sth.TreeSize)
+	srv.indexingStatus.begin(gaps)
 	if position.ContainsFirstN(sth.TreeSize) {
-		return nil
+		return srv.buildHashTiles(ctx, sth)
 	}
 
-	log.Printf("Downloaded STH with tree size %d", sth.TreeSize)
+	srv.log.Printf("Downloaded STH with tree size %d", sth.TreeSize)
 
-	type gap struct {
-		begin, end uint64
-	}
-	var gaps []gap
-	for begin, end := range position.Gaps {
-		gaps = append(gaps, gap{begin, end})
-	}
-
-	const workers = 500
-	results := make(chan leafHashes, workers)
-	group, ctx := errgroup.WithContext(context.Background())
-	group.SetLimit(1 + workers)
+	results := make(chan leafHashes, srv.indexWorkers)
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(1 + srv.indexWorkers)
 	group.Go(func() error {
-		tx, err := srv.db.Begin()
-		if err != nil {
-			return fmt.Errorf("error starting database transaction: %w", err)
-		}
-		defer func() { tx.Rollback() }()
+		// storage is written with a context that isn't canceled, so what
+		// has been indexed can be committed after ctx is done
+		storageCtx := context.WithoutCancel(groupCtx)
+		defer srv.storage.Rollback()
 		uncommitted := 0
-		for ctx.Err() == nil && !position.ContainsFirstN(sth.TreeSize) {
+	loop:
+		for !position.ContainsFirstN(sth.TreeSize) {
 			select {
-			case <-ctx.Done():
-				return ctx.Err()
+			case <-groupCtx.Done():
+				// commit what we have so far so it's not lost
+				break loop
 			case hashes := <-results:
-				if err := srv.processLeafHashes(tx, &position, hashes); err != nil {
+				if err := srv.processLeafHashes(storageCtx, &position, hashes); err != nil {
 					return fmt.Errorf("error processing leaf hashes at %d: %w", hashes.startIndex, err)
 				}
 				uncommitted++
 				if uncommitted == 10 {
-					if err := commit(tx, position); err != nil {
+					if err := srv.commit(storageCtx, position); err != nil {
 						return err
 					}
-					if newTx, err := srv.db.Begin(); err != nil {
-						return fmt.Errorf("error starting database transaction: %w", err)
-					} else {
-						tx = newTx
-					}
+					srv.indexedSize.Store(indexedPrefix(&position))
+					srv.indexingStatus.update(unindexedGaps(&position, sth.TreeSize))
 					uncommitted = 0
 				}
 			}
 		}
-		if err := commit(tx, position); err != nil {
+		if err := srv.commit(storageCtx, position); err != nil {
 			return err
 		}
-		if ctx.Err() != nil {
-			return ctx.Err()
+		srv.indexedSize.Store(indexedPrefix(&position))
+		srv.indexingStatus.update(unindexedGaps(&position, sth.TreeSize))
+		if groupCtx.Err() != nil {
+			return groupCtx.Err()
 		}
 		if rootHash := position.Subtree(0).CalculateRoot(); rootHash != merkletree.Hash(sth.SHA256RootHash) {
-			return fmt.Errorf("root hash computed from leaves (%x) doesn't match STH root hash (%x) for tree size %d", rootHash[:], sth.SHA256RootHash[:], sth.TreeSize)
+			err := fmt.Errorf("root hash computed from leaves (%x) doesn't match STH root hash (%x) for tree size %d", rootHash[:], sth.SHA256RootHash[:], sth.TreeSize)
+			srv.raiseAlert(groupCtx, &Alert{Type: "root_mismatch", Message: err.Error(), Checkpoint: string(sth.checkpoint)})
+			return err
 		}
-		if err := srv.storeSTH(sth); err != nil {
+		if err := srv.storeSTH(groupCtx, sth); err != nil {
 			return err
 		}
 
-		log.Printf("All entries indexed, updated STH to tree size %d", sth.TreeSize)
+		srv.log.Printf("All entries indexed, updated STH to tree size %d", sth.TreeSize)
 		return nil
 	})
 	startTime := time.Now()
 	var numEntries uint64
 	for _, gap := range gaps {
-		if ctx.Err() != nil {
+		if groupCtx.Err() != nil {
 			break
 		}
 		begin, end := gap.begin, gap.end
-		if end == 0 {
-			end = sth.TreeSize
-		}
 		numEntries += end - begin
-		log.Printf("Indexing entries in range [%d, %d)...", begin, end)
-		for ctx.Err() == nil && begin < end {
+		srv.log.Printf("Indexing entries in range [%d, %d)...", begin, end)
+		for groupCtx.Err() == nil && begin < end {
 			tile := begin / entriesPerTile
 			skip := begin % entriesPerTile
 			count := min(entriesPerTile-skip, end-begin)
 			begin += count
 
 			group.Go(func() error {
-				return srv.downloadLeafHashes(ctx, sth, tile, skip, count, results)
+				return srv.downloadLeafHashes(groupCtx, sth, tile, skip, count, results)
 			})
 		}
 	}
@@ -174,76 +244,161 @@ func (srv *Server) tick() error {
 		return err
 	}
 	timeElapsed := time.Since(startTime)
-	log.Printf("Indexed %d entries in %s (%f entries per second)", numEntries, timeElapsed, float64(numEntries)/timeElapsed.Seconds())
-	return nil
+	srv.metrics.indexingRate.set(nil, float64(numEntries)/timeElapsed.Seconds())
+	srv.log.Printf("Indexed %d entries in %s (%f entries per second)", numEntries, timeElapsed, float64(numEntries)/timeElapsed.Seconds())
+	return srv.buildHashTiles(ctx, sth)
+}
+
+// indexedPrefix returns the number of leading leaves contained in position
+func indexedPrefix(position *merkletree.FragmentedCollapsedTree) uint64 {
+	if position.NumSubtrees() == 0 || position.Subtree(0).Offset() != 0 {
+		return 0
+	}
+	return position.Subtree(0).Size()
 }
 
 func (srv *Server) downloadLeafHashes(ctx context.Context, sth *signedTreeHead, tile uint64, skip uint64, count uint64, results chan<- leafHashes) error {
-	data, err := downloadTile(ctx, srv.userAgent, sth, srv.monitoringPrefix, "0", tile)
+	data, err := srv.fetchTile(ctx, sth, 0, tile)
 	if err != nil {
 		return logContactError{fmt.Errorf("error downloading leaf tile %d: %w", tile, err)}
 	}
 	if minLen := (skip + count) * merkletree.HashLen; uint64(len(data)) < minLen {
 		return logContactError{fmt.Errorf("server returned %d bytes for tile %d, but we were expecting at least %d", len(data), tile, minLen)}
 	}
+	var tile0 tlog.Tile
+	var tileData []byte
+	if srv.localProofs {
+		// the tile may have been downloaded for a larger tree than sth's,
+		// but hashes beyond sth can't be verified yet
+		width := min(uint64(len(data)/merkleHashLen), sth.TreeSize-tile*entriesPerTile)
+		tile0 = tlog.Tile{H: tileHeight, L: 0, N: int64(tile), W: int(width)}
+		tileData = data[:width*merkleHashLen]
+	}
 	data = data[skip*merkletree.HashLen:]
 
 	hashes := make([][]byte, count)
 	for i := range count {
 		hashes[i] = data[i*merkleHashLen : (i+1)*merkleHashLen]
 	}
+	result := leafHashes{startIndex: tile*entriesPerTile + skip, hashes: hashes, tile: tile0, tileData: tileData}
+	if srv.certIndex || srv.dnsIndex || srv.precertIndex {
+		entries, err := srv.downloadDataTile(ctx, sth, tile, skip, count)
+		if err != nil {
+			return logContactError{fmt.Errorf("error downloading data tile %d: %w", tile, err)}
+		}
+		for i := range entries {
+			if leafHash := tlog.RecordHash(entries[i].leafInput()); !bytes.Equal(leafHash[:], hashes[i]) {
+				return &integrityError{fmt.Errorf("entry %d has leaf hash %x, but level 0 tile contains %x", result.startIndex+uint64(i), leafHash[:], hashes[i])}
+			}
+			if srv.certIndex {
+				result.certHashes = append(result.certHashes, entries[i].certSHA256())
+			}
+			if srv.dnsIndex {
+				// entries with unparsable certificates just aren't indexed
+				names, _ := parseDNSNames(entries[i].cert())
+				result.dnsNames = append(result.dnsNames, names)
+			}
+			if srv.precertIndex {
+				var tbsHash []byte
+				if entries[i].tbsCertificate != nil {
+					sum := sha256.Sum256(entries[i].tbsCertificate)
+					tbsHash = sum[:]
+				}
+				result.tbsHashes = append(result.tbsHashes, tbsHash)
+			}
+		}
+	}
 	select {
 	case <-ctx.Done():
 		return logContactError{ctx.Err()}
-	case results <- leafHashes{startIndex: tile*entriesPerTile + skip, hashes: hashes}:
+	case results <- result:
 		return nil
 	}
 }
 
-func (srv *Server) processLeafHashes(tx *sql.Tx, position *merkletree.FragmentedCollapsedTree, hashes leafHashes) error {
+func (srv *Server) processLeafHashes(ctx context.Context, position *merkletree.FragmentedCollapsedTree, hashes leafHashes) error {
 	start := time.Now()
-	defer func() { log.Printf("processed leaf hashes from %d in %s", hashes.startIndex, time.Since(start)) }()
+	defer func() { srv.log.Printf("processed leaf hashes from %d in %s", hashes.startIndex, time.Since(start)) }()
 
 	entryIndex := hashes.startIndex
 	for _, hash := range hashes.hashes {
 		if err := position.AddHash(entryIndex, merkletree.Hash(hash)); err != nil {
 			panic(err)
 		}
+		entryIndex++
+	}
+	if err := srv.storage.PutLeaves(ctx, hashes.startIndex, hashes.hashes); err != nil {
+		return err
+	}
+	srv.metrics.indexedEntries.add(nil, float64(len(hashes.hashes)))
 
-		if _, err := tx.Exec(`INSERT INTO leaf (hash, position) VALUES ($1, $2) ON CONFLICT (hash) DO UPDATE SET position = EXCLUDED.position WHERE EXCLUDED.position < leaf.position`, hash, entryIndex); err != nil {
+	// the tile and the other indexes are added to the same batch as the
+	// leaves.  The tile is pending until buildHashTiles verifies it.
+	if hashes.tileData != nil {
+		if err := srv.tiles.PutPendingTile(ctx, hashes.tile, hashes.tileData); err != nil {
+			return err
+		}
+	}
+	if hashes.certHashes != nil {
+		if err := srv.indexes.PutCertHashes(ctx, hashes.startIndex, hashes.certHashes); err != nil {
+			return err
+		}
+	}
+	if hashes.tbsHashes != nil {
+		if err := srv.indexes.PutPrecertHashes(ctx, hashes.startIndex, hashes.tbsHashes); err != nil {
+			return err
+		}
+	}
+	if hashes.dnsNames != nil {
+		if err := srv.indexes.PutDNSNames(ctx, hashes.startIndex, hashes.dnsNames); err != nil {
 			return err
 		}
-
-		entryIndex++
 	}
 	return nil
 }
 
-func (srv *Server) downloadSTH() (*signedTreeHead, error) {
-	checkpointURL := srv.monitoringPrefix.JoinPath("checkpoint")
-	checkpointBytes, err := downloadRetry(context.Background(), srv.userAgent, checkpointURL.String())
+func (srv *Server) downloadSTH(ctx context.Context) (*signedTreeHead, error) {
+	checkpointURL := srv.checkpointURL
+	if checkpointURL == nil {
+		checkpointURL = srv.monitoringPrefix.JoinPath("checkpoint")
+	}
+	checkpointBytes, err := srv.downloadRetry(ctx, checkpointURL.String())
 	if err != nil {
 		return nil, err
 	}
 
-	sth, err := parseCheckpoint(checkpointBytes, srv.logID)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing checkpoint: %w", err)
+	sth, err := parseCheckpoint(checkpointBytes, srv.origin, srv.logID)
+	if originErr := (*originError)(nil); errors.As(err, &originErr) {
+		// if no checkpoint has been accepted yet, Sunglasses is probably
+		// misconfigured, which isn't the log's fault
+		if srv.upstreamSTH.Load() != nil {
+			srv.raiseAlert(ctx, &Alert{Type: "origin_mismatch", Message: err.Error(), Checkpoint: string(checkpointBytes)})
+		}
+		return nil, err
+	} else if err != nil {
+		err = fmt.Errorf("error parsing checkpoint: %w", err)
+		srv.raiseAlert(ctx, &Alert{Type: "malformed_checkpoint", Message: err.Error(), Checkpoint: string(checkpointBytes)})
+		return nil, err
+	}
+	if srv.logKey != nil {
+		if err := sth.verify(srv.logKey); err != nil {
+			err = fmt.Errorf("checkpoint for tree size %d has invalid signature: %w", sth.TreeSize, err)
+			srv.raiseAlert(ctx, &Alert{Type: "invalid_signature", Message: err.Error(), Checkpoint: string(checkpointBytes)})
+			return nil, err
+		}
 	}
 	return sth, nil
 }
 
-func commit(tx *sql.Tx, position merkletree.FragmentedCollapsedTree) error {
-	log.Printf("committing...")
+func (srv *Server) commit(ctx context.Context, position merkletree.FragmentedCollapsedTree) error {
+	srv.log.Printf("committing...")
 	start := time.Now()
 	if positionBytes, err := json.Marshal(position); err != nil {
 		return fmt.Errorf("error marshaling position: %w", err)
-	} else if _, err := tx.Exec(`UPDATE state SET position = $1`, positionBytes); err != nil {
-		return fmt.Errorf("error storing position in database: %w", err)
-	}
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("error committing transaction: %w", err)
+	} else if err := srv.storage.Commit(ctx, positionBytes); err != nil {
+		return err
 	}
-	log.Printf("committed transaction in %s", time.Since(start))
+	srv.metrics.commitDuration.observeSince(nil, start)
+	srv.log.Printf("committed transaction in %s", time.Since(start))
 	return nil
 }
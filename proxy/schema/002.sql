@@ -0,0 +1,6 @@
+CREATE TABLE tile (
+	level		INTEGER NOT NULL,
+	number		BIGINT NOT NULL,
+	data		BLOB NOT NULL,
+	PRIMARY KEY (level, number)
+) WITHOUT ROWID;
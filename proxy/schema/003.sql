@@ -0,0 +1,9 @@
+CREATE TABLE partial_tile (
+	level		INTEGER NOT NULL,
+	number		BIGINT NOT NULL,
+	width		INTEGER NOT NULL,
+	data		BLOB NOT NULL,
+	PRIMARY KEY (level, number)
+) WITHOUT ROWID;
+
+ALTER TABLE state ADD COLUMN mirror_size BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,8 @@
+CREATE TABLE sth_history (
+	tree_size	BIGINT NOT NULL,
+	timestamp	BIGINT NOT NULL,
+	root_hash	BLOB NOT NULL,
+	signature	BLOB NOT NULL,
+	checkpoint	BLOB,
+	PRIMARY KEY (tree_size, timestamp)
+);
@@ -0,0 +1,4 @@
+CREATE TABLE precert (
+	tbs_sha256	BLOB NOT NULL PRIMARY KEY,
+	position	BIGINT NOT NULL
+) WITHOUT ROWID;
@@ -0,0 +1,8 @@
+CREATE TABLE submission (
+	leaf_index	BIGINT NOT NULL,
+	cert_sha256	BLOB NOT NULL,
+	precert		BOOLEAN NOT NULL,
+	timestamp	BIGINT NOT NULL,
+	overdue		BOOLEAN NOT NULL DEFAULT FALSE,
+	PRIMARY KEY (leaf_index, cert_sha256)
+) WITHOUT ROWID;
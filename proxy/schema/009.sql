@@ -0,0 +1 @@
+ALTER TABLE state ADD COLUMN proof_size BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- the first leaf index from which each index is complete; NULL if the index isn't maintained
+ALTER TABLE state ADD COLUMN cert_index_start BIGINT;
+ALTER TABLE state ADD COLUMN dns_index_start BIGINT;
+ALTER TABLE state ADD COLUMN precert_index_start BIGINT;
@@ -1,6 +1,35 @@
 package schema
 
-import "embed"
+import (
+	"embed"
+	"io/fs"
+)
 
 //go:embed *.sql
 var Files embed.FS
+
+//go:embed postgres/*.sql
+var postgresFiles embed.FS
+
+//go:embed issuer/*.sql issuer/postgres/*.sql
+var issuerFiles embed.FS
+
+// PostgresFiles contains the PostgreSQL equivalents of Files
+var PostgresFiles fs.FS
+
+// IssuerFiles and IssuerPostgresFiles contain the schema of a database
+// which only caches issuers, for sharing among many logs
+var IssuerFiles, IssuerPostgresFiles fs.FS
+
+func init() {
+	var err error
+	if PostgresFiles, err = fs.Sub(postgresFiles, "postgres"); err != nil {
+		panic(err)
+	}
+	if IssuerFiles, err = fs.Sub(issuerFiles, "issuer"); err != nil {
+		panic(err)
+	}
+	if IssuerPostgresFiles, err = fs.Sub(issuerFiles, "issuer/postgres"); err != nil {
+		panic(err)
+	}
+}
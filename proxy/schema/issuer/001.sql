@@ -0,0 +1,4 @@
+CREATE TABLE issuer (
+	sha256		BLOB NOT NULL PRIMARY KEY,
+	data		BLOB NOT NULL
+);
@@ -0,0 +1,4 @@
+CREATE TABLE issuer (
+	sha256		BYTEA NOT NULL PRIMARY KEY,
+	data		BYTEA NOT NULL
+);
@@ -0,0 +1,16 @@
+CREATE TABLE state (
+	sth		BYTEA,
+	position	BYTEA
+);
+INSERT INTO state DEFAULT VALUES;
+CREATE UNIQUE INDEX state_singleton ON state ((1));
+
+CREATE TABLE issuer (
+	sha256		BYTEA NOT NULL PRIMARY KEY,
+	data		BYTEA NOT NULL
+);
+
+CREATE TABLE leaf (
+	hash		BYTEA NOT NULL PRIMARY KEY,
+	position	BIGINT NOT NULL
+);
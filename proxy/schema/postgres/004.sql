@@ -0,0 +1,8 @@
+CREATE TABLE sth_history (
+	tree_size	BIGINT NOT NULL,
+	timestamp	BIGINT NOT NULL,
+	root_hash	BYTEA NOT NULL,
+	signature	BYTEA NOT NULL,
+	checkpoint	BYTEA,
+	PRIMARY KEY (tree_size, timestamp)
+);
@@ -0,0 +1,4 @@
+CREATE TABLE cert (
+	sha256		BYTEA NOT NULL PRIMARY KEY,
+	position	BIGINT NOT NULL
+);
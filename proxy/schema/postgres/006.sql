@@ -0,0 +1,5 @@
+CREATE TABLE dns_name (
+	name		TEXT COLLATE "C" NOT NULL, -- labels in reverse order, e.g. com.example.www
+	position	BIGINT NOT NULL,
+	PRIMARY KEY (name, position)
+);
@@ -0,0 +1,4 @@
+CREATE TABLE precert (
+	tbs_sha256	BYTEA NOT NULL PRIMARY KEY,
+	position	BIGINT NOT NULL
+);
@@ -0,0 +1,9 @@
+-- level 0 tiles stored by the indexer, which are moved to tile and
+-- partial_tile once they have been verified against an STH
+CREATE TABLE pending_tile (
+	level		INTEGER NOT NULL,
+	number		BIGINT NOT NULL,
+	width		INTEGER NOT NULL,
+	data		BYTEA NOT NULL,
+	PRIMARY KEY (level, number)
+);
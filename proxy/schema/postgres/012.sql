@@ -0,0 +1,3 @@
+-- when the indexer last downloaded a checkpoint, in Unix nanoseconds, so that
+-- frontends can tell whether the state is fresh
+ALTER TABLE state ADD COLUMN contact_time BIGINT;
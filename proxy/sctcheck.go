@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/cryptobyte"
+	cryptobyte_asn1 "golang.org/x/crypto/cryptobyte/asn1"
+	"golang.org/x/mod/sumdb/tlog"
+	"net/http"
+)
+
+type checkSCTRequest struct {
+	Chain   [][]byte `json:"chain"`    // certificate followed by its issuer
+	SCTList []byte   `json:"sct_list"` // TLS-encoded SignedCertificateTimestampList; if omitted, the certificate's embedded SCTs are used
+}
+
+type checkSCTResult struct {
+	Timestamp uint64      `json:"timestamp"`
+	LeafIndex uint64      `json:"leaf_index"`
+	Status    string      `json:"status"` // "included", "not_yet_included", or "mismatch"
+	TreeSize  uint64      `json:"tree_size"`
+	AuditPath []tlog.Hash `json:"audit_path,omitempty"`
+}
+
+type checkSCTResponse struct {
+	Results []checkSCTResult `json:"results"`
+}
+
+type sct struct {
+	logID      LogID
+	timestamp  uint64
+	extensions []byte
+	leafIndex  uint64
+}
+
+// parseSCTList returns the SCTs in the given list which were issued by the
+// log with the given ID.  SCTs from other logs are skipped without parsing
+// their extensions, since they need not have a LeafIndex extension.
+func parseSCTList(list []byte, logID LogID) ([]sct, error) {
+	var scts []sct
+	var sctList cryptobyte.String
+	input := cryptobyte.String(list)
+	if !input.ReadUint16LengthPrefixed(&sctList) || !input.Empty() {
+		return nil, errors.New("malformed SCT list")
+	}
+	for !sctList.Empty() {
+		var str, extensions cryptobyte.String
+		var version uint8
+		var s sct
+		if !sctList.ReadUint16LengthPrefixed(&str) || !str.ReadUint8(&version) {
+			return nil, errors.New("malformed SCT")
+		}
+		if version != 0 {
+			continue
+		}
+		if !str.CopyBytes(s.logID[:]) || !str.ReadUint64(&s.timestamp) || !str.ReadUint16LengthPrefixed(&extensions) {
+			return nil, errors.New("malformed SCT")
+		}
+		if s.logID != logID {
+			continue
+		}
+		s.extensions = extensions
+		if leafIndex, ok, err := sctLeafIndex(extensions); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, errors.New("SCT is missing LeafIndex extension")
+		} else {
+			s.leafIndex = leafIndex
+		}
+		scts = append(scts, s)
+	}
+	return scts, nil
+}
+
+// sctLeafIndex returns the value of the LeafIndex extension in the given SCT extensions
+func sctLeafIndex(extensions []byte) (uint64, bool, error) {
+	str := cryptobyte.String(extensions)
+	for !str.Empty() {
+		var extType uint8
+		var extData cryptobyte.String
+		if !str.ReadUint8(&extType) || !str.ReadUint16LengthPrefixed(&extData) {
+			return 0, false, errors.New("malformed SCT extensions")
+		}
+		if extType != 0 {
+			continue
+		}
+		if len(extData) != 5 {
+			return 0, false, errors.New("LeafIndex extension has wrong length")
+		}
+		return decodeUint40(([5]byte)(extData)), true, nil
+	}
+	return 0, false, nil
+}
+
+// embeddedSCTList returns the TLS-encoded SCT list embedded in the given certificate
+func embeddedSCTList(certDER []byte) ([]byte, error) {
+	var cert, tbs cryptobyte.String
+	input := cryptobyte.String(certDER)
+	if !input.ReadASN1(&cert, cryptobyte_asn1.SEQUENCE) || !cert.ReadASN1(&tbs, cryptobyte_asn1.SEQUENCE) {
+		return nil, errors.New("malformed certificate")
+	}
+	var extensions cryptobyte.String
+	var hasExtensions bool
+	if !tbs.SkipOptionalASN1(cryptobyte_asn1.Tag(0).Constructed().ContextSpecific()) ||
+		!tbs.SkipASN1(cryptobyte_asn1.INTEGER) ||
+		!tbs.SkipASN1(cryptobyte_asn1.SEQUENCE) ||
+		!tbs.SkipASN1(cryptobyte_asn1.SEQUENCE) ||
+		!tbs.SkipASN1(cryptobyte_asn1.SEQUENCE) ||
+		!tbs.SkipASN1(cryptobyte_asn1.SEQUENCE) ||
+		!tbs.SkipASN1(cryptobyte_asn1.SEQUENCE) ||
+		!tbs.SkipOptionalASN1(cryptobyte_asn1.Tag(1).ContextSpecific()) ||
+		!tbs.SkipOptionalASN1(cryptobyte_asn1.Tag(2).ContextSpecific()) ||
+		!tbs.ReadOptionalASN1(&extensions, &hasExtensions, cryptobyte_asn1.Tag(3).Constructed().ContextSpecific()) {
+		return nil, errors.New("malformed TBSCertificate")
+	}
+	if hasExtensions && !extensions.ReadASN1(&extensions, cryptobyte_asn1.SEQUENCE) {
+		return nil, errors.New("malformed extensions")
+	}
+	for !extensions.Empty() {
+		var extension, value cryptobyte.String
+		var oid asn1.ObjectIdentifier
+		if !extensions.ReadASN1(&extension, cryptobyte_asn1.SEQUENCE) ||
+			!extension.ReadASN1ObjectIdentifier(&oid) ||
+			!extension.SkipOptionalASN1(cryptobyte_asn1.BOOLEAN) ||
+			!extension.ReadASN1(&value, cryptobyte_asn1.OCTET_STRING) {
+			return nil, errors.New("malformed extension")
+		}
+		if !oid.Equal(oidSCTList) {
+			continue
+		}
+		var sctList cryptobyte.String
+		if !value.ReadASN1(&sctList, cryptobyte_asn1.OCTET_STRING) {
+			return nil, errors.New("malformed SCT list extension")
+		}
+		return sctList, nil
+	}
+	return nil, errors.New("certificate does not contain embedded SCTs")
+}
+
+// sctLeafInput reconstructs the MerkleTreeLeaf which the log committed to for s
+func sctLeafInput(s *sct, entryType uint16, signedEntry []byte) []byte {
+	b := cryptobyte.NewBuilder([]byte{0, 0})
+	b.AddUint64(s.timestamp)
+	b.AddUint16(entryType)
+	b.AddBytes(signedEntry)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(s.extensions)
+	})
+	return b.BytesOrPanic()
+}
+
+func (srv *Server) checkSCT(w http.ResponseWriter, req *http.Request) {
+	var request checkSCTRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(request.Chain) == 0 {
+		http.Error(w, "Invalid request body: chain is empty", http.StatusBadRequest)
+		return
+	}
+
+	var entryType uint16
+	signedEntry := cryptobyte.NewBuilder(nil)
+	sctList := request.SCTList
+	if sctList != nil {
+		entryType = 0
+		signedEntry.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(request.Chain[0])
+		})
+	} else {
+		if len(request.Chain) < 2 {
+			http.Error(w, "Invalid request body: chain must contain the issuer to check embedded SCTs", http.StatusBadRequest)
+			return
+		}
+		if list, err := embeddedSCTList(request.Chain[0]); err != nil {
+			http.Error(w, "Invalid certificate: "+err.Error(), http.StatusBadRequest)
+			return
+		} else {
+			sctList = list
+		}
+		issuer, err := x509.ParseCertificate(request.Chain[1])
+		if err != nil {
+			http.Error(w, "Invalid issuer: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		tbs, err := reconstructPrecertTBS(request.Chain[0])
+		if err != nil {
+			http.Error(w, "Invalid certificate: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		issuerKeyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+		entryType = 1
+		signedEntry.AddBytes(issuerKeyHash[:])
+		signedEntry.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(tbs)
+		})
+	}
+	scts, err := parseSCTList(sctList, srv.logID)
+	if err != nil {
+		http.Error(w, "Invalid SCT list: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sth := srv.sth.Load()
+	if sth == nil {
+		http.Error(w, "not yet synchronized with upstream log", http.StatusServiceUnavailable)
+		return
+	}
+
+	hashReader := srv.hashReader(req.Context(), sth)
+	response := checkSCTResponse{Results: []checkSCTResult{}}
+	for i := range scts {
+		s := &scts[i]
+		result := checkSCTResult{Timestamp: s.timestamp, LeafIndex: s.leafIndex, TreeSize: sth.TreeSize}
+		if s.leafIndex >= sth.TreeSize {
+			result.Status = "not_yet_included"
+			response.Results = append(response.Results, result)
+			continue
+		}
+		hashes, err := hashReader.ReadHashes([]int64{tlog.StoredHashIndex(0, int64(s.leafIndex))})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error reading leaf hash: %s", err), http.StatusBadGateway)
+			return
+		}
+		if tlog.RecordHash(sctLeafInput(s, entryType, signedEntry.BytesOrPanic())) != hashes[0] {
+			result.Status = "mismatch"
+			response.Results = append(response.Results, result)
+			continue
+		}
+		proof, err := tlog.ProveRecord(int64(sth.TreeSize), int64(s.leafIndex), hashReader)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result.Status = "included"
+		result.AuditPath = proof
+		response.Results = append(response.Results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// encodeSCT encodes the SignedCertificateTimestamp from an add-chain response
+func encodeSCT(response *addChainResponse) []byte {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(0) // sct_version
+	b.AddBytes(response.ID)
+	b.AddUint64(response.Timestamp)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(response.Extensions) })
+	b.AddBytes(response.Signature)
+	return b.BytesOrPanic()
+}
+
+// encodeSCTList encodes a SignedCertificateTimestampList containing the given encoded SCTs
+func encodeSCTList(scts ...[]byte) []byte {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, sct := range scts {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(sct) })
+		}
+	})
+	return b.BytesOrPanic()
+}
+
+// leafIndexExtension encodes SCT extensions containing only a LeafIndex extension
+func leafIndexExtension(index uint64) []byte {
+	return []byte{0, 0, 5, byte(index >> 32), byte(index >> 24), byte(index >> 16), byte(index >> 8), byte(index)}
+}
+
+// merkleTreeLeaf encodes the MerkleTreeLeaf for an entry with the given type and signed_entry
+func merkleTreeLeaf(timestamp uint64, entryType uint16, signedEntry []byte, extensions []byte) []byte {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(0) // version
+	b.AddUint8(0) // leaf_type = timestamped_entry
+	b.AddUint64(timestamp)
+	b.AddUint16(entryType)
+	b.AddBytes(signedEntry)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(extensions) })
+	return b.BytesOrPanic()
+}
+
+func TestParseSCTList(t *testing.T) {
+	keys := generateTestKeys(t)
+	logKey, otherKey := keys["ECDSA"], keys["Ed25519"]
+	logID := LogID(sha256.Sum256(marshalPublicKey(t, logKey.Public())))
+	entry := []byte{0, 0, 1, 0}
+	sct7 := encodeSCT(signSCT(t, logKey, 1700000000007, 0, entry, leafIndexExtension(7)))
+	sct9 := encodeSCT(signSCT(t, logKey, 1700000000009, 0, entry, leafIndexExtension(9)))
+	otherSCT := encodeSCT(signSCT(t, otherKey, 1700000000001, 0, entry, nil))
+	withoutLeafIndex := encodeSCT(signSCT(t, logKey, 1700000000002, 0, entry, nil))
+	otherExtension := encodeSCT(signSCT(t, logKey, 1700000000003, 0, entry, append([]byte{1, 0, 2, 0xff, 0xff}, leafIndexExtension(3)...)))
+	wrongLength := encodeSCT(signSCT(t, logKey, 1700000000004, 0, entry, []byte{0, 0, 4, 0, 0, 0, 4}))
+	truncatedExtensions := encodeSCT(signSCT(t, logKey, 1700000000005, 0, entry, []byte{0, 0, 5, 0, 0}))
+	futureVersion := append([]byte{1}, bytes.Repeat([]byte{0xff}, 20)...)
+
+	tests := []struct {
+		name  string
+		list  []byte
+		want  []uint64 // leaf indexes of the returned SCTs
+		valid bool
+	}{
+		{"single SCT", encodeSCTList(sct7), []uint64{7}, true},
+		{"empty list", encodeSCTList(), nil, true},
+		{"mixed logs", encodeSCTList(otherSCT, sct7, sct9), []uint64{7, 9}, true},
+		{"other logs only", encodeSCTList(otherSCT), nil, true},
+		{"future SCT version", encodeSCTList(futureVersion, sct9), []uint64{9}, true},
+		{"other extension before LeafIndex", encodeSCTList(otherExtension), []uint64{3}, true},
+		{"missing LeafIndex", encodeSCTList(otherSCT, withoutLeafIndex), nil, false},
+		{"LeafIndex with wrong length", encodeSCTList(wrongLength), nil, false},
+		{"truncated extensions", encodeSCTList(truncatedExtensions), nil, false},
+		{"truncated SCT", encodeSCTList(sct7[:20]), nil, false},
+		{"truncated list", encodeSCTList(sct7, sct9)[:50], nil, false},
+		{"trailing data", append(encodeSCTList(sct7), 0), nil, false},
+		{"empty input", nil, nil, false},
+	}
+	for _, test := range tests {
+		scts, err := parseSCTList(test.list, logID)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: parseSCTList succeeded", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseSCTList failed: %s", test.name, err)
+			continue
+		}
+		var leafIndexes []uint64
+		for _, s := range scts {
+			if s.logID != logID || s.timestamp != 1700000000000+s.leafIndex {
+				t.Errorf("%s: parseSCTList returned the wrong SCT: %+v", test.name, s)
+			}
+			leafIndexes = append(leafIndexes, s.leafIndex)
+		}
+		if !slices.Equal(leafIndexes, test.want) {
+			t.Errorf("%s: parseSCTList returned SCTs for leaves %v, want %v", test.name, leafIndexes, test.want)
+		}
+	}
+}
+
+func TestEmbeddedSCTList(t *testing.T) {
+	ca := newTestCA(t, "Intermediate", nil)
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := encodeSCTList([]byte("sct"))
+	sctListExtension := func(list []byte) pkix.Extension {
+		value, err := asn1.Marshal(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pkix.Extension{Id: oidSCTList, Value: value}
+	}
+	otherExtension := pkix.Extension{Id: asn1.ObjectIdentifier{1, 2, 3, 4}, Critical: true, Value: asn1.NullBytes}
+
+	tests := []struct {
+		name string
+		cert []byte
+		want []byte // nil if an error is expected
+	}{
+		{"embedded SCTs", ca.issue(t, leafKey.Public(), 1, sctListExtension(list)), list},
+		{"after a critical extension", ca.issue(t, leafKey.Public(), 2, otherExtension, sctListExtension(list)), list},
+		{"no embedded SCTs", ca.issue(t, leafKey.Public(), 3), nil},
+		{"precertificate", ca.issue(t, leafKey.Public(), 4, poisonExtension), nil},
+		{"CA certificate", ca.cert.Raw, nil},
+		{"malformed extension", ca.issue(t, leafKey.Public(), 5, pkix.Extension{Id: oidSCTList, Value: list}), nil},
+		{"malformed certificate", []byte("garbage"), nil},
+	}
+	for _, test := range tests {
+		got, err := embeddedSCTList(test.cert)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: embeddedSCTList succeeded", test.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: embeddedSCTList failed: %s", test.name, err)
+		} else if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: embeddedSCTList returned %x, want %x", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCheckSCT(t *testing.T) {
+	ctx := context.Background()
+	keys := generateTestKeys(t)
+	logKey, otherKey := keys["ECDSA"], keys["Ed25519"]
+	log := newSignedFakeLog(t, 10, logKey)
+	ca := newTestCA(t, "Intermediate", nil)
+	otherCA := newTestCA(t, "Other Intermediate", nil)
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a certificate logged with an x509_entry at index 10
+	cert := ca.issue(t, leafKey.Public(), 1)
+	certEntry := cryptobyte.NewBuilder(nil)
+	certEntry.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(cert) })
+	certSCT := signSCT(t, logKey, 1700000000010, 0, certEntry.BytesOrPanic(), leafIndexExtension(10))
+	certLeaf := merkleTreeLeaf(certSCT.Timestamp, 0, certEntry.BytesOrPanic(), certSCT.Extensions)
+	log.add(t, certLeaf)
+
+	// a certificate whose precertificate was logged at index 11; the
+	// TBSCertificate of the precertificate is the same as that of a
+	// certificate with no SCT list extension
+	unembedded, err := x509.ParseCertificate(ca.issue(t, leafKey.Public(), 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	precertEntry := preCertEntry(ca.cert, unembedded.RawTBSCertificate)
+	precertSCT := signSCT(t, logKey, 1700000000011, 1, precertEntry, leafIndexExtension(11))
+	precertLeaf := merkleTreeLeaf(precertSCT.Timestamp, 1, precertEntry, precertSCT.Extensions)
+	log.add(t, precertLeaf)
+	log.grow(t, 20)
+
+	otherSCT := signSCT(t, otherKey, 1700000000001, 1, precertEntry, nil)
+	embeddedSCTs, err := asn1.Marshal(encodeSCTList(encodeSCT(otherSCT), encodeSCT(precertSCT)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	final := ca.issue(t, leafKey.Public(), 2, pkix.Extension{Id: oidSCTList, Value: embeddedSCTs})
+	notYetIncluded := signSCT(t, logKey, 1700000000025, 0, certEntry.BytesOrPanic(), leafIndexExtension(25))
+	wrongTimestamp := *certSCT
+	wrongTimestamp.Timestamp++
+	wrongLeaf := signSCT(t, logKey, 1700000000003, 0, certEntry.BytesOrPanic(), leafIndexExtension(3))
+	withoutLeafIndex := signSCT(t, logKey, 1700000000012, 0, certEntry.BytesOrPanic(), nil)
+
+	upstream := httptest.NewServer(log)
+	defer upstream.Close()
+	prefix, err := url.Parse(upstream.URL + "/log/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.origin = originFromSubmissionPrefix(prefix)
+	srv, err := NewServer(&Config{
+		LogID:            log.logID,
+		SubmissionPrefix: prefix,
+		MonitoringPrefix: prefix,
+		Storage:          NewMemoryStorage(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+	root, err := tlog.TreeHash(log.size, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := map[uint64][]byte{10: certLeaf, 11: precertLeaf}
+
+	type result struct {
+		leafIndex uint64
+		status    string
+	}
+	tests := []struct {
+		name    string
+		chain   [][]byte
+		sctList []*addChainResponse // nil to use the embedded SCTs
+		code    int
+		want    []result
+	}{
+		{"certificate", [][]byte{cert}, []*addChainResponse{certSCT}, http.StatusOK, []result{{10, "included"}}},
+		{"mixed logs", [][]byte{cert}, []*addChainResponse{otherSCT, notYetIncluded, certSCT}, http.StatusOK, []result{{25, "not_yet_included"}, {10, "included"}}},
+		{"other logs only", [][]byte{cert}, []*addChainResponse{otherSCT}, http.StatusOK, []result{}},
+		{"not yet included", [][]byte{cert}, []*addChainResponse{notYetIncluded}, http.StatusOK, []result{{25, "not_yet_included"}}},
+		{"wrong timestamp", [][]byte{cert}, []*addChainResponse{&wrongTimestamp}, http.StatusOK, []result{{10, "mismatch"}}},
+		{"wrong leaf", [][]byte{cert}, []*addChainResponse{wrongLeaf}, http.StatusOK, []result{{3, "mismatch"}}},
+		{"precertificate SCT for certificate", [][]byte{cert}, []*addChainResponse{precertSCT}, http.StatusOK, []result{{11, "mismatch"}}},
+		{"embedded SCTs", [][]byte{final, ca.cert.Raw}, nil, http.StatusOK, []result{{11, "included"}}},
+		{"embedded SCTs with wrong issuer", [][]byte{final, otherCA.cert.Raw}, nil, http.StatusOK, []result{{11, "mismatch"}}},
+		{"embedded SCTs without issuer", [][]byte{final}, nil, http.StatusBadRequest, nil},
+		{"no embedded SCTs", [][]byte{cert, ca.cert.Raw}, nil, http.StatusBadRequest, nil},
+		{"missing LeafIndex", [][]byte{cert}, []*addChainResponse{certSCT, withoutLeafIndex}, http.StatusBadRequest, nil},
+		{"empty chain", nil, []*addChainResponse{certSCT}, http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		request := checkSCTRequest{Chain: test.chain}
+		if test.sctList != nil {
+			var scts [][]byte
+			for _, response := range test.sctList {
+				scts = append(scts, encodeSCT(response))
+			}
+			request.SCTList = encodeSCTList(scts...)
+		}
+		body, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest("POST", "/sunglasses/v1/check-sct", bytes.NewReader(body)))
+		if rec.Code != test.code {
+			t.Errorf("%s: check-sct returned %d, want %d: %s", test.name, rec.Code, test.code, rec.Body)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		var response checkSCTResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		var got []result
+		for _, r := range response.Results {
+			got = append(got, result{r.LeafIndex, r.Status})
+			if r.TreeSize != uint64(log.size) {
+				t.Errorf("%s: result has tree size %d", test.name, r.TreeSize)
+			}
+			if r.Status == "included" {
+				if err := tlog.CheckRecord(r.AuditPath, log.size, root, int64(r.LeafIndex), tlog.RecordHash(leaves[r.LeafIndex])); err != nil {
+					t.Errorf("%s: audit path for leaf %d is invalid: %s", test.name, r.LeafIndex, err)
+				}
+			} else if r.AuditPath != nil {
+				t.Errorf("%s: %s result has an audit path", test.name, r.Status)
+			}
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: check-sct returned %v, want %v", test.name, got, test.want)
+		}
+	}
+}
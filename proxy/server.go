@@ -3,18 +3,23 @@ package proxy
 import (
 	"cmp"
 	"context"
+	"crypto"
 	"database/sql"
-	"encoding/json"
 	"fmt"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/mod/sumdb/tlog"
+	"io/fs"
+	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"software.sslmate.com/src/certspotter/merkletree"
 	"src.agwa.name/go-dbutil/dbschema"
-	"src.agwa.name/sunglasses/proxy/schema"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const tileHeight = 8
@@ -24,98 +29,369 @@ const merkleHashLen = 32
 type LogID [32]byte
 
 type Server struct {
-	logID            LogID
-	db               *sql.DB
-	issuerCache      *sync.Map // [32]byte -> []byte; used when db is nil
-	monitoringPrefix *url.URL
-	userAgent        string
-	mux              *http.ServeMux
-	sth              atomic.Pointer[signedTreeHead]
-	disableLeafIndex bool
+	logID               LogID
+	logKey              crypto.PublicKey  // nil if checkpoint signatures aren't verified
+	storage             Storage           // nil if there is no database or Config.Storage
+	closeStorage        bool              // whether Close should close storage, which was opened for Config.DBPath
+	tiles               TileStorage       // storage, if it implements TileStorage
+	indexes             IndexStorage      // storage, if it implements IndexStorage
+	history             HistoryStorage    // storage, if it implements HistoryStorage
+	submissions         SubmissionStorage // storage, if it implements SubmissionStorage
+	issuers             *IssuerStore
+	tileCache           *tileCache // used when tiles is nil
+	monitoringPrefix    *url.URL
+	origin              string   // expected origin line of checkpoints
+	checkpointURL       *url.URL // nil to download from monitoringPrefix
+	userAgent           string
+	httpClient          *http.Client
+	log                 *log.Logger
+	mux                 *http.ServeMux
+	sth                 atomic.Pointer[signedTreeHead] // served by get-sth; fully indexed unless serveUnindexedSTH
+	upstreamSTH         atomic.Pointer[signedTreeHead] // latest STH accepted from the log
+	metrics             *metrics
+	indexingStatus      indexingStatus
+	lastUpstreamContact atomic.Int64 // UnixNano of the last successful checkpoint download
+	readyMaxLag         uint64
+	readyMaxStaleness   time.Duration
+	disableLeafIndex    bool
+	serveUnindexedSTH   bool
+	verifyEntries       bool
+	mirror              bool
+	alertSinks          []AlertSink
+	recentAlertsMu      sync.Mutex
+	recentAlerts        map[string]time.Time // key -> when raised
+	pendingAlerts       sync.WaitGroup       // alerts being sent to alertSinks
+	certIndex           bool
+	dnsIndex            bool
+	precertIndex        bool
+	mmd                 time.Duration
+	verifySCTs          bool
+	witnesses           []*witness
+	witnessQuorum       int
+	witnessMaxAge       time.Duration
+	witnessStallSince   atomic.Int64  // when checkpoints started lacking a witness quorum, in Unix nanoseconds; 0 if they aren't
+	indexedSize         atomic.Uint64 // number of leading leaves which are in the leaf index
+	localProofs         bool
+	frontend            bool
+	proofSize           atomic.Uint64 // tree size up to which all hash tiles are stored locally
+	certIndexStart      atomic.Uint64 // first leaf index from which the certificate index is complete; noCoverage if none
+	dnsIndexStart       atomic.Uint64 // likewise for the DNS name index
+	precertIndexStart   atomic.Uint64 // likewise for the precertificate index
+	pollInterval        time.Duration
+	indexWorkers        int
+	getEntriesTiles     uint64
+	maxGetEntries       uint64
 }
 
 type Config struct {
-	LogID            LogID
-	DBPath           string
-	SubmissionPrefix *url.URL
-	MonitoringPrefix *url.URL
-	UserAgent        string
-	UnsafeNoFsync    bool
-	DisableLeafIndex bool
+	LogID             LogID   // may be omitted if LogPublicKey is set
+	LogPublicKey      []byte  // PEM or DER SubjectPublicKeyInfo; if set, checkpoint signatures are verified
+	DBPath            string  // path to SQLite database, or PostgreSQL connection URL (postgres://...)
+	Storage           Storage // alternative to DBPath; see Storage for the features which need it to implement optional interfaces
+	SubmissionPrefix  *url.URL
+	MonitoringPrefix  *url.URL
+	Origin            string   // expected checkpoint origin; defaults to SubmissionPrefix without the scheme, per static-ct-api
+	CheckpointURL     *url.URL // URL of a witness or distributor to download cosigned checkpoints from; defaults to the log's checkpoint
+	UserAgent         string
+	UnsafeNoFsync     bool
+	DisableLeafIndex  bool
+	Frontend          bool          // don't contact the log for checkpoints or index it; serve the state stored in the database by another instance
+	ServeUnindexedSTH bool          // serve the latest checkpoint before it has been indexed
+	VerifyEntries     bool          // check entries from data tiles against the level 0 tiles
+	VerifySCTs        bool          // verify SCTs returned by add-chain and add-pre-chain; requires LogPublicKey
+	Mirror            bool          // store all tiles and issuers and serve only from there; requires DBPath or a Storage which implements TileStorage
+	PollInterval      time.Duration // how often to download the checkpoint; defaults to 1 minute
+	IndexWorkers      int           // number of concurrent leaf tile downloads when indexing; defaults to 500
+	TileCacheSize     int           // number of full tiles to cache in memory when DBPath is empty; defaults to 1024
+	GetEntriesTiles   int           // maximum number of data tiles to download for a get-entries request; defaults to 1
+	MaxGetEntries     int           // maximum number of entries to return from get-entries; defaults to GetEntriesTiles*256
+	ReadyMaxLag       uint64        // maximum number of unindexed entries for /readyz to succeed; defaults to 65536
+	ReadyMaxStaleness time.Duration // maximum time since the log was contacted for /readyz to succeed; defaults to 10*PollInterval
+	CertIndex         bool          // index entries by certificate SHA-256 (requires downloading data tiles when indexing)
+	DNSIndex          bool          // index entries by DNS name (requires downloading data tiles when indexing)
+	LocalProofs       bool          // store level 0 tiles when indexing and compute higher-level tiles, so proofs are served without contacting the log
+	PrecertIndex      bool          // index precertificate entries by TBSCertificate hash (requires downloading data tiles when indexing)
+	MMD               time.Duration // maximum merge delay, after which SCTs returned by add-chain and add-pre-chain must be incorporated; defaults to 24 hours
+	Witnesses         []string      // verifier keys (NAME+KEYID+KEY) of witnesses whose cosignatures are required on checkpoints
+	WitnessQuorum     int           // number of Witnesses which must cosign a checkpoint; defaults to len(Witnesses)
+	WitnessMaxAge     time.Duration // maximum age of a cosignature; defaults to 1 hour
+	AlertSinks        []AlertSink   // notified when the log misbehaves, in addition to logging
+	HTTPClient        *http.Client  // defaults to http.DefaultClient
+	IssuerStore       *IssuerStore  // defaults to the storage, or memory if there is none
+	Logger            *log.Logger   // defaults to log.Default()
 }
 
 func NewServer(config *Config) (*Server, error) {
-	// Use NORMAL instead of FULL for better write performance (30%
-	// improvement in throughput per one source). We may lose recent commits if
-	// there's a power loss, but we can easily recreate the data the next time
-	// Sunglasses runs. The database will not be corrupted.
-	synchronous := "NORMAL"
-	if config.UnsafeNoFsync {
-		// Database can be corrupted if there's a power failure, but commits
-		// can be "orders of magnitude" faster.
-		synchronous = "OFF"
+	// zero values mean the default, but negative values are never meaningful
+	if config.PollInterval < 0 {
+		return nil, fmt.Errorf("poll interval must not be negative")
+	}
+	if config.IndexWorkers < 0 {
+		return nil, fmt.Errorf("number of index workers must not be negative")
+	}
+	if config.TileCacheSize < 0 {
+		return nil, fmt.Errorf("tile cache size must not be negative")
+	}
+	if config.GetEntriesTiles < 0 {
+		return nil, fmt.Errorf("get-entries tiles must not be negative")
+	}
+	if config.MaxGetEntries < 0 {
+		return nil, fmt.Errorf("maximum get-entries size must not be negative")
+	}
+	if config.ReadyMaxStaleness < 0 {
+		return nil, fmt.Errorf("ready max staleness must not be negative")
+	}
+	if config.MMD < 0 {
+		return nil, fmt.Errorf("MMD must not be negative")
+	}
+	if config.WitnessQuorum < 0 {
+		return nil, fmt.Errorf("witness quorum must not be negative")
+	}
+	if config.WitnessMaxAge < 0 {
+		return nil, fmt.Errorf("witness max age must not be negative")
 	}
 	server := &Server{
-		logID:            config.LogID,
-		monitoringPrefix: config.MonitoringPrefix,
-		userAgent:        cmp.Or(config.UserAgent, "src.agwa.name/sunglasses/proxy"),
-		mux:              http.NewServeMux(),
-		disableLeafIndex: config.DisableLeafIndex,
+		logID:             config.LogID,
+		monitoringPrefix:  config.MonitoringPrefix,
+		origin:            config.Origin,
+		checkpointURL:     config.CheckpointURL,
+		userAgent:         cmp.Or(config.UserAgent, "src.agwa.name/sunglasses/proxy"),
+		httpClient:        cmp.Or(config.HTTPClient, http.DefaultClient),
+		log:               cmp.Or(config.Logger, log.Default()),
+		mux:               http.NewServeMux(),
+		metrics:           newMetrics(),
+		disableLeafIndex:  config.DisableLeafIndex,
+		serveUnindexedSTH: config.ServeUnindexedSTH,
+		verifyEntries:     config.VerifyEntries,
+		verifySCTs:        config.VerifySCTs,
+		mirror:            config.Mirror,
+		alertSinks:        config.AlertSinks,
+		recentAlerts:      make(map[string]time.Time),
+		certIndex:         config.CertIndex,
+		dnsIndex:          config.DNSIndex,
+		precertIndex:      config.PrecertIndex,
+		localProofs:       config.LocalProofs,
+		frontend:          config.Frontend,
+		mmd:               cmp.Or(config.MMD, 24*time.Hour),
+		witnessQuorum:     cmp.Or(config.WitnessQuorum, len(config.Witnesses)),
+		witnessMaxAge:     cmp.Or(config.WitnessMaxAge, time.Hour),
+		pollInterval:      cmp.Or(config.PollInterval, time.Minute),
+		indexWorkers:      cmp.Or(config.IndexWorkers, 500),
+		getEntriesTiles:   uint64(cmp.Or(config.GetEntriesTiles, 1)),
+	}
+	server.readyMaxLag = cmp.Or(config.ReadyMaxLag, 65536)
+	server.readyMaxStaleness = cmp.Or(config.ReadyMaxStaleness, 10*server.pollInterval)
+	server.maxGetEntries = uint64(cmp.Or(config.MaxGetEntries, int(server.getEntriesTiles)*entriesPerTile))
+	if server.origin == "" {
+		server.origin = originFromSubmissionPrefix(config.SubmissionPrefix)
+	}
+	if config.LogPublicKey != nil {
+		key, logID, err := parseLogPublicKey(config.LogPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing log public key: %w", err)
+		}
+		if config.LogID != (LogID{}) && config.LogID != logID {
+			return nil, fmt.Errorf("log ID %x does not match log public key, which has log ID %x", config.LogID[:], logID[:])
+		}
+		server.logID = logID
+		server.logKey = key
+	} else if config.LogID == (LogID{}) {
+		return nil, fmt.Errorf("log ID or log public key must be specified")
+	}
+	for _, vkey := range config.Witnesses {
+		w, err := parseWitness(vkey)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing witness key %q: %w", vkey, err)
+		}
+		for _, other := range server.witnesses {
+			if other.name == w.name && other.keyID == w.keyID {
+				return nil, fmt.Errorf("witness %s with key ID %x is specified more than once", w.name, w.keyID)
+			}
+		}
+		server.witnesses = append(server.witnesses, w)
+	}
+	if server.witnessQuorum > len(server.witnesses) {
+		return nil, fmt.Errorf("witness quorum %d exceeds the number of witnesses (%d)", server.witnessQuorum, len(server.witnesses))
+	}
+	if config.VerifySCTs && config.LogPublicKey == nil {
+		return nil, fmt.Errorf("verifying SCTs requires the log public key")
+	}
+	if config.DBPath != "" && config.Storage != nil {
+		return nil, fmt.Errorf("DBPath and Storage are mutually exclusive")
+	}
+	// a database opened for DBPath is a SQLStorage, which implements every interface
+	_, isTileStorage := config.Storage.(TileStorage)
+	_, isIndexStorage := config.Storage.(IndexStorage)
+	hasTileStorage := config.DBPath != "" || isTileStorage
+	hasIndexStorage := config.DBPath != "" || isIndexStorage
+	if config.Mirror && !hasTileStorage {
+		return nil, fmt.Errorf("mirror mode requires a database or a Storage which implements TileStorage")
+	}
+	if (config.CertIndex || config.DNSIndex || config.PrecertIndex) && (!hasIndexStorage || config.DisableLeafIndex) {
+		return nil, fmt.Errorf("certificate, DNS name, and precertificate indexes require a database (or a Storage which implements IndexStorage) and the leaf index")
+	}
+	if config.Frontend && config.DBPath == "" && config.Storage == nil {
+		return nil, fmt.Errorf("frontend mode requires a database or storage")
+	}
+	if config.LocalProofs && (!hasTileStorage || config.DisableLeafIndex) {
+		return nil, fmt.Errorf("local proofs require a database (or a Storage which implements TileStorage) and the leaf index")
+	}
+	if config.Mirror && config.ServeUnindexedSTH {
+		return nil, fmt.Errorf("mirror mode cannot be used with serving unindexed STHs")
 	}
 	submissionProxy := &httputil.ReverseProxy{
 		Rewrite: func(r *httputil.ProxyRequest) {
 			r.SetURL(config.SubmissionPrefix)
 		},
 	}
-	server.mux.Handle("POST /ct/v1/add-chain", submissionProxy)
-	server.mux.Handle("POST /ct/v1/add-pre-chain", submissionProxy)
-	server.mux.HandleFunc("GET /ct/v1/get-sth", server.getSTH)
-	server.mux.HandleFunc("GET /ct/v1/get-sth-consistency", server.getSTHConsistency)
-	server.mux.HandleFunc("GET /ct/v1/get-proof-by-hash", server.getProofByHash)
-	server.mux.HandleFunc("GET /ct/v1/get-entries", server.getEntries)
-	server.mux.Handle("GET /ct/v1/get-roots", submissionProxy)
-	server.mux.HandleFunc("GET /ct/v1/get-entry-and-proof", server.getEntryAndProof)
+	recordingProxy := &httputil.ReverseProxy{
+		Rewrite:        submissionProxy.Rewrite,
+		ModifyResponse: server.handleSubmissionResponse,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			server.log.Printf("error proxying submission: %s", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		},
+	}
+	server.mux.Handle("POST /ct/v1/add-chain", server.instrument("add-chain", server.captureSubmission(false, recordingProxy)))
+	server.mux.Handle("POST /ct/v1/add-pre-chain", server.instrument("add-pre-chain", server.captureSubmission(true, recordingProxy)))
+	server.mux.Handle("GET /ct/v1/get-sth", server.instrument("get-sth", http.HandlerFunc(server.getSTH)))
+	server.mux.Handle("GET /ct/v1/get-sth-consistency", server.instrument("get-sth-consistency", http.HandlerFunc(server.getSTHConsistency)))
+	server.mux.Handle("GET /ct/v1/get-proof-by-hash", server.instrument("get-proof-by-hash", http.HandlerFunc(server.getProofByHash)))
+	server.mux.Handle("GET /ct/v1/get-entries", server.instrument("get-entries", http.HandlerFunc(server.getEntries)))
+	server.mux.Handle("GET /ct/v1/get-roots", server.instrument("get-roots", submissionProxy))
+	server.mux.Handle("GET /ct/v1/get-entry-and-proof", server.instrument("get-entry-and-proof", http.HandlerFunc(server.getEntryAndProof)))
+	server.mux.Handle("GET /checkpoint", server.instrument("checkpoint", http.HandlerFunc(server.getCheckpoint)))
+	server.mux.Handle("GET /tile/", server.instrument("tile", http.HandlerFunc(server.getStaticTile)))
+	server.mux.Handle("GET /issuer/{fingerprint}", server.instrument("issuer", http.HandlerFunc(server.getStaticIssuer)))
+	server.mux.Handle("GET /sunglasses/v1/lookup-by-cert-sha256", server.instrument("lookup-by-cert-sha256", http.HandlerFunc(server.lookupByCertSHA256)))
+	server.mux.Handle("GET /sunglasses/v1/search-dns-name", server.instrument("search-dns-name", http.HandlerFunc(server.searchDNSName)))
+	server.mux.Handle("POST /sunglasses/v1/lookup-precert-by-cert", server.instrument("lookup-precert-by-cert", http.HandlerFunc(server.lookupPrecertByCert)))
+	server.mux.Handle("POST /sunglasses/v1/check-sct", server.instrument("check-sct", http.HandlerFunc(server.checkSCT)))
+	server.mux.HandleFunc("GET /metrics", server.getMetrics)
+	server.mux.HandleFunc("GET /healthz", server.getHealthz)
+	server.mux.HandleFunc("GET /readyz", server.getReadyz)
 
+	server.storage = config.Storage
+	var opened *SQLStorage // closed if NewServer fails
 	if config.DBPath != "" {
-		db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000&_foreign_keys=ON&_txlock=immediate&_journal_mode=WAL&_synchronous=%s", url.PathEscape(config.DBPath), url.PathEscape(synchronous)))
+		storage, err := OpenSQLStorage(config.DBPath, config.UnsafeNoFsync)
 		if err != nil {
-			return nil, fmt.Errorf("error opening database: %w", err)
+			return nil, err
 		}
 		defer func() {
-			if db != nil {
-				db.Close()
+			if opened != nil {
+				opened.Close()
 			}
 		}()
-		if err := dbschema.Build(context.Background(), db, schema.Files); err != nil {
-			return nil, fmt.Errorf("error building database schema: %w", err)
-		}
+		server.storage = storage
+		server.closeStorage = true
+		opened = storage
+	}
+	server.tiles, _ = server.storage.(TileStorage)
+	server.indexes, _ = server.storage.(IndexStorage)
+	server.history, _ = server.storage.(HistoryStorage)
+	server.submissions, _ = server.storage.(SubmissionStorage)
+	if server.tiles == nil {
+		server.tileCache = newTileCache(cmp.Or(config.TileCacheSize, 1024))
+	}
+	if server.storage != nil && server.history == nil {
+		server.log.Printf("%T doesn't implement HistoryStorage; only checking consistency with STHs seen since startup", server.storage)
+	}
+	if server.storage != nil && server.submissions == nil {
+		server.log.Printf("%T doesn't implement SubmissionStorage; not tracking whether SCTs are incorporated", server.storage)
+	}
 
-		var sthBytes []byte
-		if err := db.QueryRow(`SELECT sth FROM state`).Scan(&sthBytes); err != nil {
-			return nil, fmt.Errorf("error loading STH from database: %w", err)
-		}
-		if sthBytes != nil {
-			sth := new(signedTreeHead)
-			if err := json.Unmarshal(sthBytes, sth); err != nil {
-				return nil, fmt.Errorf("STH stored in database is corrupted: %w", err)
-			}
+	if server.storage != nil {
+		if sth, err := server.loadSTH(context.Background()); err != nil {
+			return nil, err
+		} else if sth != nil {
 			server.sth.Store(sth)
 		}
-		server.db = db
-		db = nil // prevent defer from closing db
+		var position merkletree.FragmentedCollapsedTree
+		if err := server.loadPosition(context.Background(), &position); err != nil {
+			return nil, err
+		}
+		server.indexedSize.Store(indexedPrefix(&position))
+		server.issuers = &IssuerStore{storage: server.storage}
 	} else {
-		server.issuerCache = new(sync.Map)
+		server.issuers = NewIssuerStore()
+	}
+	if server.localProofs {
+		proofSize, err := server.tiles.LoadProofSize(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		server.proofSize.Store(proofSize)
+	}
+	if server.indexes != nil && !server.frontend {
+		if err := server.initIndexCoverage(context.Background()); err != nil {
+			return nil, err
+		}
+	} else if server.indexes != nil {
+		if err := server.loadIndexCoverage(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	if config.IssuerStore != nil {
+		server.issuers = config.IssuerStore
 	}
 
+	opened = nil // prevent defer from closing storage
 	return server, nil
 }
 
+// isPostgresDSN reports whether a database path is actually a PostgreSQL connection URL
+func isPostgresDSN(path string) bool {
+	return strings.HasPrefix(path, "postgres://") || strings.HasPrefix(path, "postgresql://")
+}
+
+// openDB opens the SQLite database at path, or the PostgreSQL database if path
+// is a postgres:// URL, and builds the schema in sqliteFiles or postgresFiles
+func openDB(path string, synchronous string, sqliteFiles, postgresFiles fs.FS) (*sql.DB, error) {
+	if isPostgresDSN(path) {
+		return openPostgres(path, postgresFiles)
+	}
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000&_foreign_keys=ON&_txlock=immediate&_journal_mode=WAL&_synchronous=%s", url.PathEscape(path), url.PathEscape(synchronous)))
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+	if err := dbschema.Build(context.Background(), db, sqliteFiles); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error building database schema: %w", err)
+	}
+	return db, nil
+}
+
+func openPostgres(dsn string, files fs.FS) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+	if err := dbschema.Build(context.Background(), db, files); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error building database schema: %w", err)
+	}
+	return db, nil
+}
+
 func (srv *Server) tileReader(ctx context.Context) tlog.TileReader {
-	return &tileReader{ctx: ctx, prefix: srv.monitoringPrefix, userAgent: srv.userAgent}
+	return &tileReader{ctx: ctx, srv: srv, offline: srv.mirror}
 }
 
+// hashReader returns a HashReader for sth's tree, which reads tiles only from
+// local storage if they have all been mirrored or computed locally
 func (srv *Server) hashReader(ctx context.Context, sth *signedTreeHead) tlog.HashReader {
-	return tlog.TileHashReader(sth.tlogTree(), srv.tileReader(ctx))
+	offline := srv.mirror || (srv.localProofs && sth.TreeSize <= srv.proofSize.Load())
+	return tlog.TileHashReader(sth.tlogTree(), &tileReader{ctx: ctx, srv: srv, offline: offline})
+}
+
+// Close closes the database opened for Config.DBPath, if any.  It must not be
+// called until Run has returned.  Config.Storage is left open.
+func (srv *Server) Close() error {
+	if srv.closeStorage {
+		return srv.storage.Close()
+	}
+	return nil
 }
 
 func (srv *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/cryptobyte"
+	"software.sslmate.com/src/certspotter/tlstypes"
+)
+
+const ed25519SignatureAlgorithm tlstypes.SignatureAlgorithm = 7
+const intrinsicHashAlgorithm tlstypes.HashAlgorithm = 8
+
+// parseLogPublicKey parses a PEM or DER-encoded SubjectPublicKeyInfo and
+// returns the key along with the log ID derived from it.
+func parseLogPublicKey(input []byte) (crypto.PublicKey, LogID, error) {
+	der := input
+	if block, _ := pem.Decode(input); block != nil {
+		if block.Type != "PUBLIC KEY" {
+			return nil, LogID{}, fmt.Errorf("PEM block has type %q instead of \"PUBLIC KEY\"", block.Type)
+		}
+		der = block.Bytes
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, LogID{}, err
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, LogID{}, fmt.Errorf("unsupported public key type %T", key)
+	}
+	return key, LogID(sha256.Sum256(der)), nil
+}
+
+// verifyDigitallySigned verifies a TLS DigitallySigned struct over message.
+func verifyDigitallySigned(key crypto.PublicKey, message []byte, signatureBytes []byte) error {
+	var signature tlstypes.DigitallySigned
+	str := cryptobyte.String(signatureBytes)
+	if !signature.Unmarshal(&str) || !str.Empty() {
+		return errors.New("malformed DigitallySigned struct")
+	}
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if signature.Algorithm.Signature != tlstypes.ECDSA || signature.Algorithm.Hash != tlstypes.SHA256 {
+			return fmt.Errorf("log key is ECDSA but signature algorithm is %d/%d", signature.Algorithm.Hash, signature.Algorithm.Signature)
+		}
+		digest := sha256.Sum256(message)
+		if !ecdsa.VerifyASN1(key, digest[:], signature.Signature) {
+			return errors.New("ECDSA signature is incorrect")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if signature.Algorithm.Signature != ed25519SignatureAlgorithm || signature.Algorithm.Hash != intrinsicHashAlgorithm {
+			return fmt.Errorf("log key is Ed25519 but signature algorithm is %d/%d", signature.Algorithm.Hash, signature.Algorithm.Signature)
+		}
+		if !ed25519.Verify(key, message, signature.Signature) {
+			return errors.New("Ed25519 signature is incorrect")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// verify checks the STH's signature over the RFC 6962 TreeHeadSignature structure
+func (sth *signedTreeHead) verify(key crypto.PublicKey) error {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(0) // version = v1
+	b.AddUint8(1) // signature_type = tree_hash
+	b.AddUint64(sth.Timestamp)
+	b.AddUint64(sth.TreeSize)
+	b.AddBytes(sth.SHA256RootHash)
+	return verifyDigitallySigned(key, b.BytesOrPanic(), sth.TreeHeadSignature)
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/pem"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func generateTestKeys(t *testing.T) map[string]crypto.Signer {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{"ECDSA": ecdsaKey, "Ed25519": ed25519Key}
+}
+
+func TestParseLogPublicKey(t *testing.T) {
+	for name, signer := range generateTestKeys(t) {
+		der := marshalPublicKey(t, signer.Public())
+		for _, input := range [][]byte{der, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})} {
+			key, logID, err := parseLogPublicKey(input)
+			if err != nil {
+				t.Errorf("%s: error parsing key: %s", name, err)
+				continue
+			}
+			if logID != LogID(sha256.Sum256(der)) {
+				t.Errorf("%s: log ID is %x, expected SHA-256 of the DER key", name, logID[:])
+			}
+			if !signer.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key) {
+				t.Errorf("%s: parsed key is different from the original", name)
+			}
+		}
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der := marshalPublicKey(t, rsaKey.Public())
+	for name, input := range map[string][]byte{
+		"RSA":             der,
+		"wrong PEM":       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		"garbage":         []byte("not a key"),
+		"truncated":       der[:len(der)-1],
+		"empty":           {},
+		"private key PEM": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+	} {
+		if _, _, err := parseLogPublicKey(input); err == nil {
+			t.Errorf("%s: parseLogPublicKey succeeded", name)
+		}
+	}
+}
+
+func TestVerifySTH(t *testing.T) {
+	keys := generateTestKeys(t)
+	root := sha256.Sum256([]byte("root"))
+	for name, signer := range keys {
+		signature, err := signTreeHead(signer, 1700000000000, 1000, root[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherRoot := sha256.Sum256([]byte("other root"))
+		var otherKey crypto.PublicKey
+		for otherName, other := range keys {
+			if otherName != name {
+				otherKey = other.Public()
+			}
+		}
+		sameTypeKey := generateTestKeys(t)[name].Public()
+		truncated := signature[:len(signature)-1]
+		corrupted := append([]byte(nil), signature...)
+		corrupted[len(corrupted)-1] ^= 1
+
+		tests := []struct {
+			name  string
+			key   crypto.PublicKey
+			sth   signedTreeHead
+			valid bool
+		}{
+			{"valid", signer.Public(), signedTreeHead{TreeSize: 1000, Timestamp: 1700000000000, SHA256RootHash: root[:], TreeHeadSignature: signature}, true},
+			{"tampered root", signer.Public(), signedTreeHead{TreeSize: 1000, Timestamp: 1700000000000, SHA256RootHash: otherRoot[:], TreeHeadSignature: signature}, false},
+			{"tampered tree size", signer.Public(), signedTreeHead{TreeSize: 1001, Timestamp: 1700000000000, SHA256RootHash: root[:], TreeHeadSignature: signature}, false},
+			{"tampered timestamp", signer.Public(), signedTreeHead{TreeSize: 1000, Timestamp: 1700000000001, SHA256RootHash: root[:], TreeHeadSignature: signature}, false},
+			{"corrupted signature", signer.Public(), signedTreeHead{TreeSize: 1000, Timestamp: 1700000000000, SHA256RootHash: root[:], TreeHeadSignature: corrupted}, false},
+			{"truncated signature", signer.Public(), signedTreeHead{TreeSize: 1000, Timestamp: 1700000000000, SHA256RootHash: root[:], TreeHeadSignature: truncated}, false},
+			{"other log's key", sameTypeKey, signedTreeHead{TreeSize: 1000, Timestamp: 1700000000000, SHA256RootHash: root[:], TreeHeadSignature: signature}, false},
+			{"other key type", otherKey, signedTreeHead{TreeSize: 1000, Timestamp: 1700000000000, SHA256RootHash: root[:], TreeHeadSignature: signature}, false},
+		}
+		for _, test := range tests {
+			if err := test.sth.verify(test.key); test.valid && err != nil {
+				t.Errorf("%s: %s: verify failed: %s", name, test.name, err)
+			} else if !test.valid && err == nil {
+				t.Errorf("%s: %s: verify succeeded", name, test.name)
+			}
+		}
+	}
+}
+
+func TestCheckpointFromOtherLog(t *testing.T) {
+	keys := generateTestKeys(t)
+	log := newSignedFakeLog(t, 10, keys["ECDSA"])
+	log.origin = "example.com/log"
+	checkpoint, err := log.checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseCheckpoint(checkpoint, log.origin, log.logID); err != nil {
+		t.Fatalf("error parsing checkpoint: %s", err)
+	}
+	otherLogID := LogID(sha256.Sum256(marshalPublicKey(t, keys["Ed25519"].Public())))
+	if _, err := parseCheckpoint(checkpoint, log.origin, otherLogID); err == nil {
+		t.Error("parseCheckpoint accepted a checkpoint signed by another log")
+	}
+
+	if _, err := NewServer(&Config{
+		LogID:            otherLogID,
+		LogPublicKey:     marshalPublicKey(t, keys["ECDSA"].Public()),
+		SubmissionPrefix: &url.URL{Scheme: "https", Host: "example.com", Path: "/log/"},
+		MonitoringPrefix: &url.URL{Scheme: "https", Host: "example.com", Path: "/log/"},
+	}); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("NewServer accepted a log ID which doesn't match the public key: %v", err)
+	}
+}
+
+func TestTickRejectsInvalidSignature(t *testing.T) {
+	for name, signer := range generateTestKeys(t) {
+		t.Run(name, func(t *testing.T) {
+			log := newSignedFakeLog(t, 300, signer)
+			upstream := httptest.NewServer(log)
+			defer upstream.Close()
+			prefix, err := url.Parse(upstream.URL + "/log/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			log.origin = originFromSubmissionPrefix(prefix)
+
+			srv, err := NewServer(&Config{
+				LogPublicKey:     marshalPublicKey(t, signer.Public()),
+				SubmissionPrefix: prefix,
+				MonitoringPrefix: prefix,
+				Storage:          NewMemoryStorage(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := srv.tick(context.Background()); err != nil {
+				t.Fatalf("tick failed with a valid signature: %s", err)
+			}
+			if sth := srv.sth.Load(); sth == nil || sth.TreeSize != 300 {
+				t.Fatalf("STH wasn't advanced to tree size 300: %+v", sth)
+			}
+
+			log.grow(t, 400)
+			log.timestamp++
+			log.badRoot = true
+			if err := srv.tick(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+				t.Errorf("tick didn't fail with an invalid signature: %v", err)
+			}
+			if sth := srv.sth.Load(); sth.TreeSize != 300 {
+				t.Errorf("served STH was advanced to tree size %d", sth.TreeSize)
+			}
+			if sth := srv.upstreamSTH.Load(); sth.TreeSize != 300 {
+				t.Errorf("upstream STH was advanced to tree size %d", sth.TreeSize)
+			}
+
+			log.badRoot = false
+			if err := srv.tick(context.Background()); err != nil {
+				t.Fatalf("tick failed with a valid signature: %s", err)
+			}
+			if sth := srv.sth.Load(); sth.TreeSize != 400 {
+				t.Errorf("STH wasn't advanced to tree size 400: %+v", sth)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/mod/sumdb/tlog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The static-ct-api monitoring endpoints are served so that Sunglasses can
+// front both APIs.  The checkpoint is the one for the served STH.  Full tiles
+// within the served tree and issuers are verified and cached; everything else
+// is passed through from the log.
+
+func (srv *Server) getCheckpoint(w http.ResponseWriter, req *http.Request) {
+	sth := srv.sth.Load()
+	if sth == nil || sth.checkpoint == nil {
+		http.Error(w, "not yet synchronized with upstream log", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(sth.checkpoint)
+}
+
+func (srv *Server) getStaticTile(w http.ResponseWriter, req *http.Request) {
+	tile, err := parseTilePath(strings.TrimPrefix(req.URL.Path, "/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	data, immutable, err := srv.readStaticTile(req.Context(), tile)
+	if err != nil {
+		http.Error(w, err.Error(), upstreamErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if immutable {
+		w.Header().Set("Cache-Control", "public, max-age=604800, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// readStaticTile returns the contents of the given tile, and whether it is a
+// verified full tile
+func (srv *Server) readStaticTile(ctx context.Context, tile tlog.Tile) ([]byte, bool, error) {
+	if sth := srv.sth.Load(); sth != nil && isFullTile(tile) && tileEnd(tile) <= sth.TreeSize {
+		if tile.L >= 0 {
+			data, err := tlog.ReadTileData(tile, srv.hashReader(ctx, sth))
+			return data, true, err
+		}
+		data, err := srv.readDataTile(ctx, sth, tile)
+		return data, true, err
+	}
+	if tile.L >= 0 {
+		// partial hash tiles are available locally in mirror mode
+		if data, ok, err := srv.loadTile(ctx, tile); err != nil {
+			return nil, false, err
+		} else if ok {
+			return data, false, nil
+		}
+	}
+	data, err := srv.download(ctx, srv.monitoringPrefix.JoinPath(formatTilePath(tileLevelName(tile.L), uint64(tile.N), uint64(tile.W))).String())
+	return data, false, err
+}
+
+// readDataTile returns the given full data tile, which must be within sth,
+// verifying it against the level 0 tile and caching it
+func (srv *Server) readDataTile(ctx context.Context, sth *signedTreeHead, tile tlog.Tile) ([]byte, error) {
+	if data, ok, err := srv.loadTile(ctx, tile); err != nil {
+		return nil, err
+	} else if ok {
+		return data, nil
+	}
+	hashTile := tile
+	hashTile.L = 0
+	hashes, err := tlog.ReadTileData(hashTile, srv.hashReader(ctx, sth))
+	if err != nil {
+		return nil, err
+	}
+	data, err := srv.download(ctx, srv.monitoringPrefix.JoinPath(formatTilePath("data", uint64(tile.N), entriesPerTile)).String())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := verifyDataTile(tile, data, hashes); err != nil {
+		srv.metrics.integrityErrors.inc(nil)
+		srv.log.Print(err)
+		return nil, err
+	}
+	if err := srv.storeTile(ctx, tile, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (srv *Server) getStaticIssuer(w http.ResponseWriter, req *http.Request) {
+	fingerprint, err := hex.DecodeString(req.PathValue("fingerprint"))
+	if err != nil || len(fingerprint) != 32 {
+		http.Error(w, "Invalid issuer fingerprint", http.StatusNotFound)
+		return
+	}
+	data, err := srv.getIssuer(req.Context(), ([32]byte)(fingerprint))
+	if err != nil {
+		http.Error(w, err.Error(), upstreamErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-cert")
+	w.Header().Set("Cache-Control", "public, max-age=604800, immutable")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// tileEnd returns the tree size needed for tile to be full
+func tileEnd(tile tlog.Tile) uint64 {
+	shift := tileHeight * (max(tile.L, 0) + 1)
+	if shift >= 64 || uint64(tile.N+1) > math.MaxUint64>>shift {
+		return math.MaxUint64
+	}
+	return uint64(tile.N+1) << shift
+}
+
+func tileLevelName(level int) string {
+	if level < 0 {
+		return "data"
+	}
+	return strconv.Itoa(level)
+}
+
+// parseTilePath parses a static-ct-api tile path, such as tile/0/x001/234.p/5
+// or tile/data/567.  Data tiles have level -1.
+func parseTilePath(path string) (tlog.Tile, error) {
+	tile := tlog.Tile{H: tileHeight, W: entriesPerTile}
+	fields := strings.Split(path, "/")
+	if len(fields) < 3 || fields[0] != "tile" {
+		return tile, fmt.Errorf("malformed tile path")
+	}
+	if fields[1] == "data" {
+		tile.L = -1
+	} else if level, err := strconv.ParseUint(fields[1], 10, 8); err != nil {
+		return tile, fmt.Errorf("malformed tile level")
+	} else {
+		tile.L = int(level)
+	}
+	fields = fields[2:]
+	if len(fields) >= 2 && strings.HasSuffix(fields[len(fields)-2], ".p") {
+		width, err := strconv.ParseUint(fields[len(fields)-1], 10, 16)
+		if err != nil || width == 0 || width >= entriesPerTile {
+			return tile, fmt.Errorf("malformed tile width")
+		}
+		tile.W = int(width)
+		fields = fields[:len(fields)-1]
+		fields[len(fields)-1] = strings.TrimSuffix(fields[len(fields)-1], ".p")
+	}
+	for i, field := range fields {
+		if i < len(fields)-1 {
+			field = strings.TrimPrefix(field, "x")
+		}
+		n, err := strconv.ParseUint(field, 10, 16)
+		if err != nil || n >= 1000 || tile.N > (1<<53)/1000 {
+			return tile, fmt.Errorf("malformed tile index")
+		}
+		tile.N = tile.N*1000 + int64(n)
+	}
+	// reject non-canonical encodings, such as missing leading zeros
+	if formatTilePath(tileLevelName(tile.L), uint64(tile.N), uint64(tile.W)) != path {
+		return tile, fmt.Errorf("malformed tile path")
+	}
+	return tile, nil
+}
+
+func upstreamErrorStatus(err error) int {
+	var derr *downloadError
+	if errors.As(err, &derr) && derr.StatusCode == http.StatusNotFound {
+		return http.StatusNotFound
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"testing"
+
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+func TestParseTilePath(t *testing.T) {
+	tile := func(level int, n int64, width int) tlog.Tile {
+		return tlog.Tile{H: tileHeight, L: level, N: n, W: width}
+	}
+	tests := []struct {
+		path  string
+		tile  tlog.Tile
+		valid bool
+	}{
+		{"tile/0/000", tile(0, 0, 256), true},
+		{"tile/0/234", tile(0, 234, 256), true},
+		{"tile/1/x001/234", tile(1, 1234, 256), true},
+		{"tile/2/x001/x000/000", tile(2, 1000000, 256), true},
+		{"tile/0/x001/234.p/5", tile(0, 1234, 5), true},
+		{"tile/0/000.p/1", tile(0, 0, 1), true},
+		{"tile/0/000.p/255", tile(0, 0, 255), true},
+		{"tile/data/567", tile(-1, 567, 256), true},
+		{"tile/data/x001/567.p/128", tile(-1, 1567, 128), true},
+		{"tile/0/x009/x007/x199/x254/x740/991", tile(0, 1<<53-1, 256), true},
+
+		// non-canonical encodings
+		{"tile/0/1", tlog.Tile{}, false},
+		{"tile/0/0234", tlog.Tile{}, false},
+		{"tile/0/x000/234", tlog.Tile{}, false},
+		{"tile/0/x1/234", tlog.Tile{}, false},
+		{"tile/0/001/234", tlog.Tile{}, false},
+		{"tile/0/x001/x234", tlog.Tile{}, false},
+		{"tile/00/234", tlog.Tile{}, false},
+		{"tile/0/234.p/05", tlog.Tile{}, false},
+		{"tile/0/+23", tlog.Tile{}, false},
+		{"tile/0/x001/234/", tlog.Tile{}, false},
+
+		// bad widths
+		{"tile/0/234.p/0", tlog.Tile{}, false},
+		{"tile/0/234.p/256", tlog.Tile{}, false},
+		{"tile/0/234.p/1000", tlog.Tile{}, false},
+		{"tile/0/234.p/-1", tlog.Tile{}, false},
+		{"tile/0/234.p/", tlog.Tile{}, false},
+		{"tile/0/234.p", tlog.Tile{}, false},
+
+		// bad prefixes and levels
+		{"0/234", tlog.Tile{}, false},
+		{"tiles/0/234", tlog.Tile{}, false},
+		{"/tile/0/234", tlog.Tile{}, false},
+		{"tile/234", tlog.Tile{}, false},
+		{"tile/", tlog.Tile{}, false},
+		{"tile/-1/234", tlog.Tile{}, false},
+		{"tile/256/234", tlog.Tile{}, false},
+		{"tile/x/234", tlog.Tile{}, false},
+
+		// out-of-range indexes
+		{"tile/0/1000", tlog.Tile{}, false},
+		{"tile/0/x1000/000", tlog.Tile{}, false},
+		{"tile/0/x009/x007/x199/x254/x740/x992/000", tlog.Tile{}, false},
+	}
+	for _, test := range tests {
+		got, err := parseTilePath(test.path)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("parseTilePath(%q) accepted the path as %+v", test.path, got)
+			}
+		} else if err != nil {
+			t.Errorf("parseTilePath(%q) failed: %s", test.path, err)
+		} else if got != test.tile {
+			t.Errorf("parseTilePath(%q) = %+v, want %+v", test.path, got, test.tile)
+		}
+	}
+}
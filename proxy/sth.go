@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"golang.org/x/mod/sumdb/tlog"
+	"net/url"
 	"strconv"
 	"strings"
 )
@@ -17,6 +18,15 @@ type signedTreeHead struct {
 	Timestamp         uint64 `json:"timestamp"`
 	SHA256RootHash    []byte `json:"sha256_root_hash"`
 	TreeHeadSignature []byte `json:"tree_head_signature"`
+
+	checkpoint []byte // the signed note this STH was parsed from, if available
+}
+
+// storedSTH is the stored form of the served STH, which unlike the get-sth
+// response includes the checkpoint
+type storedSTH struct {
+	signedTreeHead
+	Checkpoint []byte `json:"checkpoint,omitempty"`
 }
 
 func (sth *signedTreeHead) tlogTree() tlog.Tree {
@@ -34,9 +44,31 @@ func chompCheckpointLine(input []byte) (string, []byte, bool) {
 	return string(input[:newline]), input[newline+1:], true
 }
 
-func parseCheckpoint(input []byte, logID LogID) (*signedTreeHead, error) {
+// originError indicates that a checkpoint's origin line is not the expected origin
+type originError struct {
+	origin   string
+	expected string
+}
+
+func (e *originError) Error() string {
+	return fmt.Sprintf("checkpoint has origin %q instead of %q", e.origin, e.expected)
+}
+
+// originFromSubmissionPrefix returns the checkpoint origin of a static-ct-api
+// log, which is its submission prefix without the scheme or trailing slashes
+func originFromSubmissionPrefix(prefix *url.URL) string {
+	return strings.TrimRight(prefix.Host+prefix.Path, "/")
+}
+
+func parseCheckpoint(input []byte, origin string, logID LogID) (*signedTreeHead, error) {
+	checkpoint := input
+
 	// origin
-	origin, input, _ := chompCheckpointLine(input)
+	if originLine, rest, _ := chompCheckpointLine(input); originLine != origin {
+		return nil, &originError{origin: originLine, expected: origin}
+	} else {
+		input = rest
+	}
 
 	// tree size
 	sizeLine, input, _ := chompCheckpointLine(input)
@@ -55,16 +87,13 @@ func parseCheckpoint(input []byte, logID LogID) (*signedTreeHead, error) {
 		return nil, fmt.Errorf("root hash has wrong length (should be %d bytes long, not %d)", merkleHashLen, len(rootHash))
 	}
 
-	// 0 or more non-empty extension lines (ignored)
-	for {
-		line, rest, ok := chompCheckpointLine(input)
-		if !ok {
-			return nil, errors.New("signed note ended prematurely")
-		}
+	// static-ct-api checkpoints have no extension lines
+	if line, rest, ok := chompCheckpointLine(input); !ok {
+		return nil, errors.New("signed note ended prematurely")
+	} else if len(line) != 0 {
+		return nil, fmt.Errorf("unexpected extension line %q", line)
+	} else {
 		input = rest
-		if len(line) == 0 {
-			break
-		}
 	}
 
 	// signature lines
@@ -96,6 +125,7 @@ func parseCheckpoint(input []byte, logID LogID) (*signedTreeHead, error) {
 			Timestamp:         timestamp,
 			SHA256RootHash:    rootHash,
 			TreeHeadSignature: signature,
+			checkpoint:        checkpoint,
 		}, nil
 	}
 }
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+func TestParseCheckpoint(t *testing.T) {
+	log := newFakeLog(t, 10)
+	log.origin = "example.com/log"
+	checkpoint, err := log.checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := tlog.TreeHash(10, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, logSignature, _ := strings.Cut(string(checkpoint), "\n\n")
+	text += "\n"
+	rootLine := base64.StdEncoding.EncodeToString(root[:])
+	otherKeyID := makeKeyID(log.origin, LogID{2})
+	otherSignature := "— example.com/log " + base64.StdEncoding.EncodeToString(append(otherKeyID[:], "a signature from another key"...)) + "\n"
+	witnessSignature := "— witness.example.com " + base64.StdEncoding.EncodeToString([]byte("a witness cosignature")) + "\n"
+	keyID := makeKeyID(log.origin, log.logID)
+	shortSignature := "— example.com/log " + base64.StdEncoding.EncodeToString(append(keyID[:], "short"...)) + "\n"
+
+	tests := []struct {
+		name       string
+		checkpoint string
+		valid      bool
+		origin     bool // error is an originError
+	}{
+		{"valid", string(checkpoint), true, false},
+		{"other signatures first", text + "\n" + witnessSignature + otherSignature + logSignature, true, false},
+		{"other origin", strings.Replace(string(checkpoint), "example.com/log\n", "example.com/other\n", 1), false, true},
+		{"origin with trailing slash", strings.Replace(string(checkpoint), "example.com/log\n", "example.com/log/\n", 1), false, true},
+		{"empty", "", false, true},
+		{"extension line", text + "extension\n\n" + logSignature, false, false},
+		{"no blank line", text, false, false},
+		{"no signatures", text + "\n", false, false},
+		{"no log signature", text + "\n" + witnessSignature + otherSignature, false, false},
+		{"short signature", text + "\n" + shortSignature, false, false},
+		{"unterminated signature", strings.TrimSuffix(string(checkpoint), "\n"), false, false},
+		{"malformed tree size", strings.Replace(text, "\n10\n", "\nten\n", 1) + "\n" + logSignature, false, false},
+		{"negative tree size", strings.Replace(text, "\n10\n", "\n-10\n", 1) + "\n" + logSignature, false, false},
+		{"malformed root hash", strings.Replace(text, rootLine, "!"+rootLine[1:], 1) + "\n" + logSignature, false, false},
+		{"short root hash", strings.Replace(text, rootLine, base64.StdEncoding.EncodeToString(root[:31]), 1) + "\n" + logSignature, false, false},
+	}
+	for _, test := range tests {
+		sth, err := parseCheckpoint([]byte(test.checkpoint), log.origin, log.logID)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s: parseCheckpoint failed: %s", test.name, err)
+			} else if sth.TreeSize != 10 || sth.Timestamp != log.timestamp || !bytes.Equal(sth.SHA256RootHash, root[:]) || !bytes.Equal(sth.TreeHeadSignature, []byte("signature")) {
+				t.Errorf("%s: parsed wrong STH %+v", test.name, sth)
+			} else if string(sth.checkpoint) != test.checkpoint {
+				t.Errorf("%s: STH retains wrong checkpoint %q", test.name, sth.checkpoint)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: parseCheckpoint succeeded", test.name)
+		} else if originErr := (*originError)(nil); errors.As(err, &originErr) != test.origin {
+			t.Errorf("%s: wrong type of error: %s", test.name, err)
+		}
+	}
+}
+
+// testAlertSink records the types of alerts
+type testAlertSink struct {
+	mu    sync.Mutex
+	types []string
+}
+
+func (sink *testAlertSink) SendAlert(ctx context.Context, alert *Alert) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.types = append(sink.types, alert.Type)
+	return nil
+}
+
+func TestTickOriginMismatch(t *testing.T) {
+	log := newFakeLog(t, 10)
+	upstream := httptest.NewServer(log)
+	defer upstream.Close()
+	prefix, err := url.Parse(upstream.URL + "/log/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.origin = "example.com/other"
+
+	alerts := new(testAlertSink)
+	srv, err := NewServer(&Config{
+		LogID:            log.logID,
+		SubmissionPrefix: prefix,
+		MonitoringPrefix: prefix,
+		Storage:          NewMemoryStorage(),
+		AlertSinks:       []AlertSink{alerts},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first checkpoint having the wrong origin is a configuration
+	// error, which is fatal and not the log's fault
+	err = srv.tick(context.Background())
+	if originErr := (*originError)(nil); !errors.As(err, &originErr) {
+		t.Fatalf("tick didn't fail with an origin error: %v", err)
+	} else if isLogContactError(err) {
+		t.Errorf("origin error for the first checkpoint is a log contact error: %s", err)
+	}
+	srv.pendingAlerts.Wait()
+	if len(alerts.types) != 0 {
+		t.Errorf("alerts were raised for the first checkpoint: %v", alerts.types)
+	}
+
+	log.origin = originFromSubmissionPrefix(prefix)
+	if err := srv.tick(context.Background()); err != nil {
+		t.Fatalf("tick failed: %s", err)
+	}
+
+	// once a checkpoint has been accepted, the log is at fault
+	log.grow(t, 20)
+	log.origin = "example.com/other"
+	err = srv.tick(context.Background())
+	if !isLogContactError(err) {
+		t.Errorf("origin error after the first checkpoint isn't a log contact error: %v", err)
+	}
+	if sth := srv.upstreamSTH.Load(); sth.TreeSize != 10 {
+		t.Errorf("upstream STH was advanced to tree size %d", sth.TreeSize)
+	}
+	srv.pendingAlerts.Wait()
+	if len(alerts.types) != 1 || alerts.types[0] != "origin_mismatch" {
+		t.Errorf("expected an origin_mismatch alert, not %v", alerts.types)
+	}
+}
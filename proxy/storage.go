@@ -0,0 +1,699 @@
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"golang.org/x/mod/sumdb/tlog"
+	"io"
+	"src.agwa.name/sunglasses/proxy/schema"
+	"sync"
+	"time"
+)
+
+// Storage persists the leaf index, the issuer cache, and the indexing state
+// (the served STH, the position of the indexer, and when the indexer last
+// contacted the log).  The STH and position are opaque byte strings.
+//
+// PutLeaves adds leaves to a pending batch, which Commit persists atomically
+// along with the new position, and Rollback discards.  PutLeaves, Commit, and
+// Rollback are only called from a single goroutine at a time; the other
+// methods may be called concurrently.
+//
+// Storage deliberately covers only what is needed to serve the RFC 6962 API
+// with a leaf index.  The other features need a Storage which also
+// implements one of the following interfaces: TileStorage for mirror mode
+// and local proofs, IndexStorage for the certificate, DNS name, and
+// precertificate indexes, HistoryStorage for the STH history (without which
+// consistency is only checked against STHs seen since startup), and
+// SubmissionStorage for tracking whether SCTs are incorporated.  SQLStorage
+// implements all of them.
+type Storage interface {
+	io.Closer
+
+	// LookupLeaf returns the first position of the leaf with the given hash
+	LookupLeaf(ctx context.Context, hash []byte) (uint64, bool, error)
+	PutLeaves(ctx context.Context, startIndex uint64, hashes [][]byte) error
+	Commit(ctx context.Context, position []byte) error
+	Rollback() error
+	LoadPosition(ctx context.Context) ([]byte, error)
+
+	LoadSTH(ctx context.Context) ([]byte, error)
+	StoreSTH(ctx context.Context, sth []byte) error
+
+	// LoadContactTime returns when a checkpoint was last downloaded from
+	// the log, or the zero time if never; frontends use it to tell
+	// whether the state written by the indexer is fresh
+	LoadContactTime(ctx context.Context) (time.Time, error)
+	StoreContactTime(ctx context.Context, contactTime time.Time) error
+
+	GetIssuer(ctx context.Context, fingerprint [32]byte) ([]byte, bool, error)
+	PutIssuer(ctx context.Context, fingerprint [32]byte, data []byte) error
+}
+
+// TileStorage is implemented by a Storage which stores tiles, so that they
+// can be served without contacting the log.  Without it, full tiles are
+// cached in memory.
+type TileStorage interface {
+	Storage
+
+	// LoadTile returns the data of the given tile, or of a wider version of
+	// it if the tile is partial.  Hash tiles are truncated by the caller.
+	LoadTile(ctx context.Context, tile tlog.Tile) ([]byte, bool, error)
+	// StoreTile stores a tile, which has been verified, keeping only the
+	// widest version of each partial tile
+	StoreTile(ctx context.Context, tile tlog.Tile, data []byte) error
+	// PutPendingTile adds a tile which hasn't been verified to the pending
+	// batch.  Pending tiles are kept apart from the stored tiles until
+	// they are verified and stored with StoreTile.
+	PutPendingTile(ctx context.Context, tile tlog.Tile, data []byte) error
+	// LoadPendingTile returns the widest pending version of the given
+	// tile, if it is at least as wide as tile
+	LoadPendingTile(ctx context.Context, tile tlog.Tile) ([]byte, bool, error)
+	// DeletePendingTile deletes every pending version of the given tile
+	DeletePendingTile(ctx context.Context, tile tlog.Tile) error
+
+	// the tree sizes up to which tiles have been mirrored or computed locally
+	LoadMirrorSize(ctx context.Context) (uint64, error)
+	StoreMirrorSize(ctx context.Context, treeSize uint64) error
+	LoadProofSize(ctx context.Context) (uint64, error)
+	StoreProofSize(ctx context.Context, treeSize uint64) error
+}
+
+// IndexStorage is implemented by a Storage which supports the certificate,
+// DNS name, and precertificate indexes.  The Put methods add to the pending
+// batch, like PutLeaves.
+type IndexStorage interface {
+	Storage
+
+	PutCertHashes(ctx context.Context, startIndex uint64, hashes [][32]byte) error
+	// PutPrecertHashes skips nil hashes, which belong to certificate entries
+	PutPrecertHashes(ctx context.Context, startIndex uint64, tbsHashes [][]byte) error
+	PutDNSNames(ctx context.Context, startIndex uint64, names [][]string) error
+
+	// LookupCert and LookupPrecert return the first position of the entry
+	// with the given certificate or TBSCertificate SHA-256 hash
+	LookupCert(ctx context.Context, hash []byte) (uint64, bool, error)
+	LookupPrecert(ctx context.Context, tbsHash []byte) (uint64, bool, error)
+	// SearchDNSName returns, in ascending order, the first limit positions
+	// in [start, end) of entries containing the DNS name, or if subdomains
+	// is true, the name or any of its subdomains
+	SearchDNSName(ctx context.Context, name string, subdomains bool, start uint64, end uint64, limit int) ([]uint64, error)
+
+	LoadIndexStarts(ctx context.Context) (IndexStarts, error)
+	StoreIndexStarts(ctx context.Context, starts IndexStarts) error
+}
+
+// IndexStarts holds the first leaf index from which each index is complete,
+// or nil if the index isn't maintained
+type IndexStarts struct {
+	Cert    *uint64
+	DNS     *uint64
+	Precert *uint64
+}
+
+// HistoryStorage is implemented by a Storage which records every STH
+// accepted from the log
+type HistoryStorage interface {
+	Storage
+
+	// LoadLatestSTHRecord returns the record with the largest tree size
+	// (and of those, the latest timestamp), or nil if there are none
+	LoadLatestSTHRecord(ctx context.Context) (*STHRecord, error)
+	// AddSTHRecord records an STH unless one with the same tree size and
+	// timestamp has already been recorded
+	AddSTHRecord(ctx context.Context, record *STHRecord) error
+}
+
+type STHRecord struct {
+	TreeSize   uint64
+	Timestamp  uint64
+	RootHash   []byte
+	Signature  []byte
+	Checkpoint []byte // nil if the STH wasn't downloaded as a checkpoint
+}
+
+// SubmissionStorage is implemented by a Storage which records the SCTs
+// returned for submissions, identified by leaf index and certificate
+// SHA-256 hash, until they are checked against the log
+type SubmissionStorage interface {
+	Storage
+
+	// PutSubmission records a submission unless it is already recorded
+	PutSubmission(ctx context.Context, submission *Submission) error
+	// LoadDueSubmissions returns the submissions whose leaf index is less
+	// than treeSize, and those which aren't overdue but whose SCT
+	// timestamp is at least mmd before timestamp, ordered by leaf index
+	LoadDueSubmissions(ctx context.Context, treeSize uint64, timestamp uint64, mmd time.Duration) ([]Submission, error)
+	MarkSubmissionOverdue(ctx context.Context, leafIndex uint64, certSHA256 []byte) error
+	DeleteSubmission(ctx context.Context, leafIndex uint64, certSHA256 []byte) error
+}
+
+type Submission struct {
+	LeafIndex  uint64
+	CertSHA256 []byte
+	Precert    bool
+	Timestamp  uint64 // of the SCT, in milliseconds
+	Overdue    bool   // the MMD elapsed without the submission being incorporated
+}
+
+// SQLStorage is a Storage backed by a SQLite or PostgreSQL database.  It
+// implements every optional storage interface.
+type SQLStorage struct {
+	db *sql.DB
+	tx *sql.Tx // pending batch; nil if none
+}
+
+// OpenSQLStorage opens the SQLite database at dbPath, which will be created if
+// necessary, or the PostgreSQL database if dbPath is a postgres:// URL.
+func OpenSQLStorage(dbPath string, unsafeNoFsync bool) (*SQLStorage, error) {
+	// Use NORMAL instead of FULL for better write performance (30%
+	// improvement in throughput per one source). We may lose recent commits if
+	// there's a power loss, but we can easily recreate the data the next time
+	// Sunglasses runs. The database will not be corrupted.
+	synchronous := "NORMAL"
+	if unsafeNoFsync {
+		// Database can be corrupted if there's a power failure, but commits
+		// can be "orders of magnitude" faster.
+		synchronous = "OFF"
+	}
+	db, err := openDB(dbPath, synchronous, schema.Files, schema.PostgresFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLStorage{db: db}, nil
+}
+
+func (s *SQLStorage) Close() error {
+	s.Rollback()
+	return s.db.Close()
+}
+
+func (s *SQLStorage) LookupLeaf(ctx context.Context, hash []byte) (uint64, bool, error) {
+	var position uint64
+	if err := s.db.QueryRowContext(ctx, `SELECT position FROM leaf WHERE hash = $1`, hash).Scan(&position); err == nil {
+		return position, true, nil
+	} else if err == sql.ErrNoRows {
+		return 0, false, nil
+	} else {
+		return 0, false, fmt.Errorf("error looking up leaf in database: %w", err)
+	}
+}
+
+// pendingTx returns the transaction for the pending batch, starting it if necessary
+func (s *SQLStorage) pendingTx() (*sql.Tx, error) {
+	if s.tx == nil {
+		// not BeginTx, since the batch is committed even after the indexer's context is done
+		tx, err := s.db.Begin()
+		if err != nil {
+			return nil, fmt.Errorf("error starting database transaction: %w", err)
+		}
+		s.tx = tx
+	}
+	return s.tx, nil
+}
+
+func (s *SQLStorage) PutLeaves(ctx context.Context, startIndex uint64, hashes [][]byte) error {
+	tx, err := s.pendingTx()
+	if err != nil {
+		return err
+	}
+	for i, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO leaf (hash, position) VALUES ($1, $2) ON CONFLICT (hash) DO UPDATE SET position = EXCLUDED.position WHERE EXCLUDED.position < leaf.position`, hash, startIndex+uint64(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLStorage) Commit(ctx context.Context, position []byte) error {
+	tx, err := s.pendingTx()
+	if err != nil {
+		return err
+	}
+	s.tx = nil
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `UPDATE state SET position = $1`, position); err != nil {
+		return fmt.Errorf("error storing position in database: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStorage) Rollback() error {
+	if s.tx == nil {
+		return nil
+	}
+	tx := s.tx
+	s.tx = nil
+	return tx.Rollback()
+}
+
+func (s *SQLStorage) LoadPosition(ctx context.Context) ([]byte, error) {
+	var position []byte
+	if err := s.db.QueryRowContext(ctx, `SELECT position FROM state`).Scan(&position); err != nil {
+		return nil, fmt.Errorf("error loading position from database: %w", err)
+	}
+	return position, nil
+}
+
+func (s *SQLStorage) LoadSTH(ctx context.Context) ([]byte, error) {
+	var sth []byte
+	if err := s.db.QueryRowContext(ctx, `SELECT sth FROM state`).Scan(&sth); err != nil {
+		return nil, fmt.Errorf("error loading STH from database: %w", err)
+	}
+	return sth, nil
+}
+
+func (s *SQLStorage) StoreSTH(ctx context.Context, sth []byte) error {
+	if _, err := s.db.ExecContext(ctx, `UPDATE state SET sth = $1`, sth); err != nil {
+		return fmt.Errorf("error storing STH in database: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStorage) LoadContactTime(ctx context.Context) (time.Time, error) {
+	var nanos sql.Null[int64]
+	if err := s.db.QueryRowContext(ctx, `SELECT contact_time FROM state`).Scan(&nanos); err != nil {
+		return time.Time{}, fmt.Errorf("error loading contact time from database: %w", err)
+	} else if !nanos.Valid {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, nanos.V), nil
+}
+
+func (s *SQLStorage) StoreContactTime(ctx context.Context, contactTime time.Time) error {
+	if _, err := s.db.ExecContext(ctx, `UPDATE state SET contact_time = $1`, contactTime.UnixNano()); err != nil {
+		return fmt.Errorf("error storing contact time in database: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStorage) GetIssuer(ctx context.Context, fingerprint [32]byte) ([]byte, bool, error) {
+	var data []byte
+	if err := s.db.QueryRowContext(ctx, `SELECT data FROM issuer WHERE sha256 = $1`, fingerprint[:]).Scan(&data); err == nil {
+		return data, true, nil
+	} else if err == sql.ErrNoRows {
+		return nil, false, nil
+	} else {
+		return nil, false, fmt.Errorf("error loading issuer from database: %w", err)
+	}
+}
+
+func (s *SQLStorage) PutIssuer(ctx context.Context, fingerprint [32]byte, data []byte) error {
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO issuer (sha256, data) VALUES ($1, $2) ON CONFLICT (sha256) DO NOTHING`, fingerprint[:], data); err != nil {
+		return fmt.Errorf("error storing issuer in database: %w", err)
+	}
+	return nil
+}
+
+// Ping checks that the database is reachable
+func (s *SQLStorage) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *SQLStorage) LoadTile(ctx context.Context, tile tlog.Tile) ([]byte, bool, error) {
+	var data []byte
+	var err error
+	if isFullTile(tile) {
+		err = s.db.QueryRowContext(ctx, `SELECT data FROM tile WHERE level = $1 AND number = $2`, tile.L, tile.N).Scan(&data)
+	} else {
+		// if the tile has since become full, the full tile is used
+		var width int
+		err = s.db.QueryRowContext(ctx, `SELECT width, data FROM partial_tile WHERE level = $1 AND number = $2 UNION ALL SELECT CAST($3 AS INTEGER), data FROM tile WHERE level = $1 AND number = $2 ORDER BY 1 DESC LIMIT 1`, tile.L, tile.N, entriesPerTile).Scan(&width, &data)
+		if err == nil && width < tile.W {
+			return nil, false, nil
+		}
+	}
+	if err == nil {
+		return data, true, nil
+	} else if err == sql.ErrNoRows {
+		return nil, false, nil
+	} else {
+		return nil, false, fmt.Errorf("error loading tile from database: %w", err)
+	}
+}
+
+func (s *SQLStorage) StoreTile(ctx context.Context, tile tlog.Tile, data []byte) error {
+	if !isFullTile(tile) {
+		if _, err := s.db.ExecContext(ctx, `INSERT INTO partial_tile (level, number, width, data) VALUES ($1, $2, $3, $4) ON CONFLICT (level, number) DO UPDATE SET width = EXCLUDED.width, data = EXCLUDED.data WHERE EXCLUDED.width > partial_tile.width`, tile.L, tile.N, tile.W, data); err != nil {
+			return fmt.Errorf("error storing partial tile in database: %w", err)
+		}
+		return nil
+	}
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO tile (level, number, data) VALUES ($1, $2, $3) ON CONFLICT (level, number) DO NOTHING`, tile.L, tile.N, data); err != nil {
+		return fmt.Errorf("error storing tile in database: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM partial_tile WHERE level = $1 AND number = $2`, tile.L, tile.N); err != nil {
+		return fmt.Errorf("error deleting partial tile from database: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStorage) PutPendingTile(ctx context.Context, tile tlog.Tile, data []byte) error {
+	tx, err := s.pendingTx()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO pending_tile (level, number, width, data) VALUES ($1, $2, $3, $4) ON CONFLICT (level, number) DO UPDATE SET width = EXCLUDED.width, data = EXCLUDED.data WHERE EXCLUDED.width > pending_tile.width`, tile.L, tile.N, tile.W, data); err != nil {
+		return fmt.Errorf("error storing pending tile in database: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStorage) LoadPendingTile(ctx context.Context, tile tlog.Tile) ([]byte, bool, error) {
+	var width int
+	var data []byte
+	if err := s.db.QueryRowContext(ctx, `SELECT width, data FROM pending_tile WHERE level = $1 AND number = $2`, tile.L, tile.N).Scan(&width, &data); err == sql.ErrNoRows {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("error loading pending tile from database: %w", err)
+	} else if width < tile.W {
+		return nil, false, nil
+	}
+	return data, true, nil
+}
+
+func (s *SQLStorage) DeletePendingTile(ctx context.Context, tile tlog.Tile) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM pending_tile WHERE level = $1 AND number = $2`, tile.L, tile.N); err != nil {
+		return fmt.Errorf("error deleting pending tile from database: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStorage) LoadMirrorSize(ctx context.Context) (uint64, error) {
+	var mirrorSize uint64
+	if err := s.db.QueryRowContext(ctx, `SELECT mirror_size FROM state`).Scan(&mirrorSize); err != nil {
+		return 0, fmt.Errorf("error loading mirror size from database: %w", err)
+	}
+	return mirrorSize, nil
+}
+
+func (s *SQLStorage) StoreMirrorSize(ctx context.Context, treeSize uint64) error {
+	if _, err := s.db.ExecContext(ctx, `UPDATE state SET mirror_size = $1`, treeSize); err != nil {
+		return fmt.Errorf("error storing mirror size in database: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStorage) LoadProofSize(ctx context.Context) (uint64, error) {
+	var proofSize uint64
+	if err := s.db.QueryRowContext(ctx, `SELECT proof_size FROM state`).Scan(&proofSize); err != nil {
+		return 0, fmt.Errorf("error loading proof size from database: %w", err)
+	}
+	return proofSize, nil
+}
+
+func (s *SQLStorage) StoreProofSize(ctx context.Context, treeSize uint64) error {
+	if _, err := s.db.ExecContext(ctx, `UPDATE state SET proof_size = $1`, treeSize); err != nil {
+		return fmt.Errorf("error storing proof size in database: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStorage) PutCertHashes(ctx context.Context, startIndex uint64, hashes [][32]byte) error {
+	tx, err := s.pendingTx()
+	if err != nil {
+		return err
+	}
+	for i, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO cert (sha256, position) VALUES ($1, $2) ON CONFLICT (sha256) DO UPDATE SET position = EXCLUDED.position WHERE EXCLUDED.position < cert.position`, hash[:], startIndex+uint64(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLStorage) PutPrecertHashes(ctx context.Context, startIndex uint64, tbsHashes [][]byte) error {
+	tx, err := s.pendingTx()
+	if err != nil {
+		return err
+	}
+	for i, tbsHash := range tbsHashes {
+		if tbsHash == nil {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO precert (tbs_sha256, position) VALUES ($1, $2) ON CONFLICT (tbs_sha256) DO UPDATE SET position = EXCLUDED.position WHERE EXCLUDED.position < precert.position`, tbsHash, startIndex+uint64(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLStorage) PutDNSNames(ctx context.Context, startIndex uint64, names [][]string) error {
+	tx, err := s.pendingTx()
+	if err != nil {
+		return err
+	}
+	for i := range names {
+		for _, name := range names[i] {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO dns_name (name, position) VALUES ($1, $2) ON CONFLICT (name, position) DO NOTHING`, reverseDNSName(name), startIndex+uint64(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *SQLStorage) LookupCert(ctx context.Context, hash []byte) (uint64, bool, error) {
+	var position uint64
+	if err := s.db.QueryRowContext(ctx, `SELECT position FROM cert WHERE sha256 = $1`, hash).Scan(&position); err == nil {
+		return position, true, nil
+	} else if err == sql.ErrNoRows {
+		return 0, false, nil
+	} else {
+		return 0, false, fmt.Errorf("error looking up certificate in database: %w", err)
+	}
+}
+
+func (s *SQLStorage) LookupPrecert(ctx context.Context, tbsHash []byte) (uint64, bool, error) {
+	var position uint64
+	if err := s.db.QueryRowContext(ctx, `SELECT position FROM precert WHERE tbs_sha256 = $1`, tbsHash).Scan(&position); err == nil {
+		return position, true, nil
+	} else if err == sql.ErrNoRows {
+		return 0, false, nil
+	} else {
+		return 0, false, fmt.Errorf("error looking up precertificate in database: %w", err)
+	}
+}
+
+func (s *SQLStorage) SearchDNSName(ctx context.Context, name string, subdomains bool, start uint64, end uint64, limit int) ([]uint64, error) {
+	reversed := reverseDNSName(name)
+	var rows *sql.Rows
+	var err error
+	if subdomains {
+		// subdomains sort between "<reversed>." and "<reversed>/" since '/' follows '.'
+		rows, err = s.db.QueryContext(ctx, `SELECT DISTINCT position FROM dns_name WHERE (name = $1 OR (name > $2 AND name < $3)) AND position >= $4 AND position < $5 ORDER BY position LIMIT $6`, reversed, reversed+".", reversed+"/", start, end, limit)
+	} else {
+		rows, err = s.db.QueryContext(ctx, `SELECT position FROM dns_name WHERE name = $1 AND position >= $2 AND position < $3 ORDER BY position LIMIT $4`, reversed, start, end, limit)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error searching DNS names in database: %w", err)
+	}
+	defer rows.Close()
+	positions := []uint64{}
+	for rows.Next() {
+		var position uint64
+		if err := rows.Scan(&position); err != nil {
+			return nil, fmt.Errorf("error searching DNS names in database: %w", err)
+		}
+		positions = append(positions, position)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error searching DNS names in database: %w", err)
+	}
+	return positions, nil
+}
+
+func (s *SQLStorage) LoadIndexStarts(ctx context.Context) (IndexStarts, error) {
+	var cert, dns, precert sql.Null[int64]
+	if err := s.db.QueryRowContext(ctx, `SELECT cert_index_start, dns_index_start, precert_index_start FROM state`).Scan(&cert, &dns, &precert); err != nil {
+		return IndexStarts{}, fmt.Errorf("error loading index coverage from database: %w", err)
+	}
+	start := func(start sql.Null[int64]) *uint64 {
+		if !start.Valid {
+			return nil
+		}
+		value := uint64(start.V)
+		return &value
+	}
+	return IndexStarts{Cert: start(cert), DNS: start(dns), Precert: start(precert)}, nil
+}
+
+func (s *SQLStorage) StoreIndexStarts(ctx context.Context, starts IndexStarts) error {
+	if _, err := s.db.ExecContext(ctx, `UPDATE state SET cert_index_start = $1, dns_index_start = $2, precert_index_start = $3`, starts.Cert, starts.DNS, starts.Precert); err != nil {
+		return fmt.Errorf("error storing index coverage in database: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStorage) LoadLatestSTHRecord(ctx context.Context) (*STHRecord, error) {
+	record := new(STHRecord)
+	if err := s.db.QueryRowContext(ctx, `SELECT tree_size, timestamp, root_hash, signature, checkpoint FROM sth_history ORDER BY tree_size DESC, timestamp DESC LIMIT 1`).Scan(&record.TreeSize, &record.Timestamp, &record.RootHash, &record.Signature, &record.Checkpoint); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error loading latest STH from database: %w", err)
+	}
+	return record, nil
+}
+
+func (s *SQLStorage) AddSTHRecord(ctx context.Context, record *STHRecord) error {
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO sth_history (tree_size, timestamp, root_hash, signature, checkpoint) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (tree_size, timestamp) DO NOTHING`, record.TreeSize, record.Timestamp, record.RootHash, record.Signature, record.Checkpoint); err != nil {
+		return fmt.Errorf("error storing STH in history: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStorage) PutSubmission(ctx context.Context, submission *Submission) error {
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO submission (leaf_index, cert_sha256, precert, timestamp) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`, submission.LeafIndex, submission.CertSHA256, submission.Precert, submission.Timestamp); err != nil {
+		return fmt.Errorf("error inserting into submission table: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStorage) LoadDueSubmissions(ctx context.Context, treeSize uint64, timestamp uint64, mmd time.Duration) ([]Submission, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT leaf_index, cert_sha256, precert, timestamp, overdue FROM submission WHERE leaf_index < $1 OR (NOT overdue AND timestamp + $2 <= $3) ORDER BY leaf_index`, treeSize, uint64(mmd.Milliseconds()), timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("error querying submission table: %w", err)
+	}
+	defer rows.Close()
+	var submissions []Submission
+	for rows.Next() {
+		var sub Submission
+		if err := rows.Scan(&sub.LeafIndex, &sub.CertSHA256, &sub.Precert, &sub.Timestamp, &sub.Overdue); err != nil {
+			return nil, fmt.Errorf("error reading submission table: %w", err)
+		}
+		submissions = append(submissions, sub)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading submission table: %w", err)
+	}
+	return submissions, nil
+}
+
+func (s *SQLStorage) MarkSubmissionOverdue(ctx context.Context, leafIndex uint64, certSHA256 []byte) error {
+	if _, err := s.db.ExecContext(ctx, `UPDATE submission SET overdue = TRUE WHERE leaf_index = $1 AND cert_sha256 = $2`, leafIndex, certSHA256); err != nil {
+		return fmt.Errorf("error updating submission table: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStorage) DeleteSubmission(ctx context.Context, leafIndex uint64, certSHA256 []byte) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM submission WHERE leaf_index = $1 AND cert_sha256 = $2`, leafIndex, certSHA256); err != nil {
+		return fmt.Errorf("error updating submission table: %w", err)
+	}
+	return nil
+}
+
+// MemoryStorage is a Storage which keeps everything in memory, and is lost
+// when the process exits.  It is useful for tests.
+type MemoryStorage struct {
+	mu       sync.Mutex
+	leaves   map[[32]byte]uint64
+	pending  map[[32]byte]uint64
+	position []byte
+	sth      []byte
+	contact  time.Time
+	issuers  map[[32]byte][]byte
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		leaves:  make(map[[32]byte]uint64),
+		pending: make(map[[32]byte]uint64),
+		issuers: make(map[[32]byte][]byte),
+	}
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+func (s *MemoryStorage) LookupLeaf(ctx context.Context, hash []byte) (uint64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	position, ok := s.leaves[[32]byte(hash)]
+	return position, ok, nil
+}
+
+func (s *MemoryStorage) PutLeaves(ctx context.Context, startIndex uint64, hashes [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, hash := range hashes {
+		position := startIndex + uint64(i)
+		if existing, ok := s.pending[[32]byte(hash)]; !ok || position < existing {
+			s.pending[[32]byte(hash)] = position
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Commit(ctx context.Context, position []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, position := range s.pending {
+		if existing, ok := s.leaves[hash]; !ok || position < existing {
+			s.leaves[hash] = position
+		}
+	}
+	clear(s.pending)
+	s.position = position
+	return nil
+}
+
+func (s *MemoryStorage) Rollback() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.pending)
+	return nil
+}
+
+func (s *MemoryStorage) LoadPosition(ctx context.Context) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.position, nil
+}
+
+func (s *MemoryStorage) LoadSTH(ctx context.Context) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sth, nil
+}
+
+func (s *MemoryStorage) StoreSTH(ctx context.Context, sth []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sth = sth
+	return nil
+}
+
+func (s *MemoryStorage) LoadContactTime(ctx context.Context) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.contact, nil
+}
+
+func (s *MemoryStorage) StoreContactTime(ctx context.Context, contactTime time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.contact = contactTime
+	return nil
+}
+
+func (s *MemoryStorage) GetIssuer(ctx context.Context, fingerprint [32]byte) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.issuers[fingerprint]
+	return data, ok, nil
+}
+
+func (s *MemoryStorage) PutIssuer(ctx context.Context, fingerprint [32]byte, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.issuers[fingerprint]; !ok {
+		s.issuers[fingerprint] = data
+	}
+	return nil
+}
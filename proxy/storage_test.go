@@ -0,0 +1,342 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/mod/sumdb/tlog"
+	"software.sslmate.com/src/certspotter/tlstypes"
+)
+
+// fakeLog serves the checkpoint and hash tiles of a static-ct-api log
+// whose leaves are the decimal representations of 0 through size-1, except
+// for those appended with add.
+type fakeLog struct {
+	origin    string
+	logID     LogID
+	signer    crypto.Signer // if nil, checkpoints have a bogus signature
+	timestamp uint64        // of checkpoints, in milliseconds
+	badRoot   bool          // serve checkpoints whose root hash doesn't match the signature
+	noPartial bool          // respond 404 to requests for partial tiles, like a log which has since grown
+	size      int64
+	hashes    map[int64]tlog.Hash
+}
+
+func newFakeLog(t *testing.T, size int64) *fakeLog {
+	log := &fakeLog{logID: LogID{1}, timestamp: 1700000000000, hashes: make(map[int64]tlog.Hash)}
+	log.grow(t, size)
+	return log
+}
+
+// newSignedFakeLog returns a fakeLog whose checkpoints are signed by signer
+func newSignedFakeLog(t *testing.T, size int64, signer crypto.Signer) *fakeLog {
+	log := newFakeLog(t, size)
+	log.signer = signer
+	log.logID = LogID(sha256.Sum256(marshalPublicKey(t, signer.Public())))
+	return log
+}
+
+func marshalPublicKey(t *testing.T, key crypto.PublicKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// grow appends leaves to the log until it has the given size
+func (log *fakeLog) grow(t *testing.T, size int64) {
+	for log.size < size {
+		log.add(t, []byte(fmt.Sprint(log.size)))
+	}
+}
+
+// add appends a leaf with the given data to the log and returns its index
+func (log *fakeLog) add(t *testing.T, data []byte) int64 {
+	hashes, err := tlog.StoredHashes(log.size, data, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j, hash := range hashes {
+		log.hashes[tlog.StoredHashIndex(0, log.size)+int64(j)] = hash
+	}
+	log.size++
+	return log.size - 1
+}
+
+// signTreeHead returns a DigitallySigned struct over the RFC 6962 TreeHeadSignature structure
+func signTreeHead(signer crypto.Signer, timestamp uint64, treeSize uint64, root []byte) ([]byte, error) {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(0) // version = v1
+	b.AddUint8(1) // signature_type = tree_hash
+	b.AddUint64(timestamp)
+	b.AddUint64(treeSize)
+	b.AddBytes(root)
+	return signDigitallySigned(signer, b.BytesOrPanic())
+}
+
+func signDigitallySigned(signer crypto.Signer, message []byte) ([]byte, error) {
+	var algorithm tlstypes.SignatureAndHashAlgorithm
+	var signature []byte
+	var err error
+	switch signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		algorithm = tlstypes.SignatureAndHashAlgorithm{Hash: tlstypes.SHA256, Signature: tlstypes.ECDSA}
+		digest := sha256.Sum256(message)
+		signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case ed25519.PublicKey:
+		algorithm = tlstypes.SignatureAndHashAlgorithm{Hash: intrinsicHashAlgorithm, Signature: ed25519SignatureAlgorithm}
+		signature, err = signer.Sign(rand.Reader, message, crypto.Hash(0))
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", signer.Public())
+	}
+	if err != nil {
+		return nil, err
+	}
+	b := cryptobyte.NewBuilder(nil)
+	b.AddValue(tlstypes.DigitallySigned{Algorithm: algorithm, Signature: signature})
+	return b.Bytes()
+}
+
+func (log *fakeLog) checkpoint() ([]byte, error) {
+	root, err := tlog.TreeHash(log.size, log)
+	if err != nil {
+		return nil, err
+	}
+	signature := []byte("signature")
+	if log.signer != nil {
+		if signature, err = signTreeHead(log.signer, log.timestamp, uint64(log.size), root[:]); err != nil {
+			return nil, err
+		}
+	}
+	if log.badRoot {
+		root[0] ^= 1
+	}
+	keyID := makeKeyID(log.origin, log.logID)
+	noteSignature := binary.BigEndian.AppendUint64(keyID[:], log.timestamp)
+	noteSignature = append(noteSignature, signature...)
+	return fmt.Appendf(nil, "%s\n%d\n%s\n\n\u2014 %s %s\n", log.origin, log.size, base64.StdEncoding.EncodeToString(root[:]), log.origin, base64.StdEncoding.EncodeToString(noteSignature)), nil
+}
+
+func (log *fakeLog) ReadHashes(indexes []int64) ([]tlog.Hash, error) {
+	hashes := make([]tlog.Hash, len(indexes))
+	for i, index := range indexes {
+		hash, ok := log.hashes[index]
+		if !ok {
+			return nil, fmt.Errorf("no hash at index %d", index)
+		}
+		hashes[i] = hash
+	}
+	return hashes, nil
+}
+
+func (log *fakeLog) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/log/")
+	if path == "checkpoint" {
+		checkpoint, err := log.checkpoint()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(checkpoint)
+		return
+	}
+	tile, err := parseTilePath(path)
+	if err != nil || tile.L < 0 || (log.noPartial && tile.W != entriesPerTile) {
+		http.NotFound(w, req)
+		return
+	}
+	data, err := tlog.ReadTileData(tile, log)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	w.Write(data)
+}
+
+func TestMemoryStorage(t *testing.T) {
+	log := newFakeLog(t, 300)
+	upstream := httptest.NewServer(log)
+	defer upstream.Close()
+	prefix, err := url.Parse(upstream.URL + "/log/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.origin = originFromSubmissionPrefix(prefix)
+
+	storage := NewMemoryStorage()
+	srv, err := NewServer(&Config{
+		LogID:            log.logID,
+		SubmissionPrefix: prefix,
+		MonitoringPrefix: prefix,
+		Storage:          storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.tick(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if sth, err := storage.LoadSTH(context.Background()); err != nil || sth == nil {
+		t.Fatalf("STH wasn't stored: %v", err)
+	}
+	if sth, err := srv.loadSTH(context.Background()); err != nil || !strings.HasPrefix(string(sth.checkpoint), log.origin+"\n300\n") {
+		t.Fatalf("stored STH doesn't include the checkpoint: %v", err)
+	}
+	for _, leaf := range []int64{0, 255, 256, 299} {
+		leafHash := tlog.RecordHash([]byte(fmt.Sprint(leaf)))
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest("GET", "/ct/v1/get-proof-by-hash?tree_size=300&hash="+url.QueryEscape(base64.StdEncoding.EncodeToString(leafHash[:])), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("get-proof-by-hash for leaf %d returned %d: %s", leaf, rec.Code, rec.Body)
+		}
+		var response struct {
+			LeafIndex int64       `json:"leaf_index"`
+			AuditPath []tlog.Hash `json:"audit_path"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.LeafIndex != leaf {
+			t.Errorf("get-proof-by-hash returned leaf index %d, expected %d", response.LeafIndex, leaf)
+		}
+		root, _ := tlog.TreeHash(log.size, log)
+		if err := tlog.CheckRecord(response.AuditPath, log.size, root, leaf, leafHash); err != nil {
+			t.Errorf("invalid audit path for leaf %d: %s", leaf, err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	missing := tlog.RecordHash([]byte("missing"))
+	srv.ServeHTTP(rec, httptest.NewRequest("GET", "/ct/v1/get-proof-by-hash?tree_size=300&hash="+url.QueryEscape(base64.StdEncoding.EncodeToString(missing[:])), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("get-proof-by-hash for missing leaf returned %d, expected %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMemoryStorageRollback(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	hash := make([]byte, 32)
+	if err := storage.PutLeaves(ctx, 5, [][]byte{hash}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.PutLeaves(ctx, 7, [][]byte{hash, hash}); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := storage.LookupLeaf(ctx, hash); found {
+		t.Error("leaf is visible before Commit")
+	}
+	if err := storage.Commit(ctx, []byte("position")); err != nil {
+		t.Fatal(err)
+	}
+	if position, found, _ := storage.LookupLeaf(ctx, hash); !found || position != 7 {
+		t.Errorf("LookupLeaf returned (%d, %v), expected (7, true)", position, found)
+	}
+	if position, _ := storage.LoadPosition(ctx); string(position) != "position" {
+		t.Errorf("LoadPosition returned %q", position)
+	}
+}
+
+func openTestSQLStorage(t *testing.T) *SQLStorage {
+	storage, err := OpenSQLStorage(filepath.Join(t.TempDir(), "sunglasses.db"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+// TestOptionalStorageInterfaces checks that the features which need more
+// than Storage work with any Storage implementing the optional interfaces,
+// not just a *SQLStorage
+func TestOptionalStorageInterfaces(t *testing.T) {
+	ctx := context.Background()
+	log := newFakeLog(t, 300)
+	upstream := httptest.NewServer(log)
+	defer upstream.Close()
+	prefix, err := url.Parse(upstream.URL + "/log/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.origin = originFromSubmissionPrefix(prefix)
+
+	wrapped := struct{ *SQLStorage }{openTestSQLStorage(t)}
+	config := &Config{
+		LogID:            log.logID,
+		SubmissionPrefix: prefix,
+		MonitoringPrefix: prefix,
+		Storage:          wrapped,
+		LocalProofs:      true,
+		CertIndex:        true,
+	}
+	srv, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.tiles == nil || srv.indexes == nil || srv.history == nil || srv.submissions == nil {
+		t.Fatal("optional interfaces of the storage weren't used")
+	}
+	if srv.certIndexStart.Load() != 0 {
+		t.Errorf("certificate index starts at %d", srv.certIndexStart.Load())
+	}
+
+	srv.certIndex = false // the fake log has no data tiles
+	if err := srv.tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+	log.grow(t, 600)
+	log.timestamp++
+	if err := srv.tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if size := srv.proofSize.Load(); size != 600 {
+		t.Errorf("hash tiles were computed up to tree size %d", size)
+	}
+	if record, err := wrapped.LoadLatestSTHRecord(ctx); err != nil {
+		t.Fatal(err)
+	} else if record == nil || record.TreeSize != 600 {
+		t.Errorf("STH history wasn't recorded: %+v", record)
+	}
+
+	// proofs are now served without contacting the log
+	upstream.Close()
+	leafHash := tlog.RecordHash([]byte("42"))
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest("GET", "/ct/v1/get-proof-by-hash?tree_size=600&hash="+url.QueryEscape(base64.StdEncoding.EncodeToString(leafHash[:])), nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("get-proof-by-hash returned %d: %s", rec.Code, rec.Body)
+	}
+
+	for _, feature := range []func(*Config){
+		func(config *Config) { config.LocalProofs = true },
+		func(config *Config) { config.Mirror = true },
+		func(config *Config) { config.CertIndex = true },
+	} {
+		config := &Config{LogID: log.logID, SubmissionPrefix: prefix, MonitoringPrefix: prefix, Storage: NewMemoryStorage()}
+		feature(config)
+		if _, err := NewServer(config); err == nil {
+			t.Errorf("NewServer accepted %+v with a MemoryStorage", config)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/cryptobyte"
+	"io"
+	"net/http"
+)
+
+// Checking of submissions made through the add-chain and add-pre-chain
+// proxy: the SCT returned by the log is optionally verified and is recorded
+// in the submission table, and checkSubmissions verifies that the log
+// incorporated it within the MMD.
+
+type addChainRequest struct {
+	Chain [][]byte `json:"chain"`
+}
+
+type addChainResponse struct {
+	SCTVersion uint8  `json:"sct_version"`
+	ID         []byte `json:"id"`
+	Timestamp  uint64 `json:"timestamp"`
+	Extensions []byte `json:"extensions"`
+	Signature  []byte `json:"signature"`
+}
+
+type submissionKey struct{}
+
+type submission struct {
+	precert bool
+	body    []byte
+}
+
+// captureSubmission saves the request body so that handleSubmissionResponse
+// can check and record the submitted chain once the log responds
+func (srv *Server) captureSubmission(precert bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if srv.submissions == nil && !srv.verifySCTs {
+			next.ServeHTTP(w, req)
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, "Error reading request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), submissionKey{}, &submission{precert: precert, body: body})))
+	})
+}
+
+// handleSubmissionResponse is the submission proxy's ModifyResponse
+// function.  It verifies the SCT if verifySCTs is enabled, returning an
+// error (causing a 502 response) if it is invalid, and records the SCT in
+// the submission table.
+func (srv *Server) handleSubmissionResponse(resp *http.Response) error {
+	ctx := resp.Request.Context()
+	sub, ok := ctx.Value(submissionKey{}).(*submission)
+	if !ok || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error reading response from log: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	chain, response, err := srv.parseSubmission(sub, body)
+	if err == nil && srv.verifySCTs {
+		err = srv.verifySCT(sub.precert, chain, response)
+	}
+	if err != nil && srv.verifySCTs {
+		srv.raiseAlert(ctx, &Alert{Type: "invalid_sct", Message: fmt.Sprintf("log returned an invalid SCT: %s", err)})
+		return fmt.Errorf("log returned an invalid SCT: %w", err)
+	} else if err != nil {
+		srv.log.Printf("error recording submission: %s", err)
+		return nil
+	}
+	if srv.submissions != nil {
+		if err := srv.storeSubmission(ctx, sub.precert, chain, response); err != nil {
+			srv.log.Printf("error recording submission: %s", err)
+		}
+	}
+	return nil
+}
+
+func (srv *Server) parseSubmission(sub *submission, responseBody []byte) ([][]byte, *addChainResponse, error) {
+	var request addChainRequest
+	if err := json.Unmarshal(sub.body, &request); err != nil {
+		return nil, nil, fmt.Errorf("error parsing request: %w", err)
+	}
+	if len(request.Chain) == 0 {
+		return nil, nil, errors.New("request has empty chain")
+	}
+	response := new(addChainResponse)
+	if err := json.Unmarshal(responseBody, response); err != nil {
+		return nil, nil, fmt.Errorf("error parsing response: %w", err)
+	}
+	if response.SCTVersion != 0 {
+		return nil, nil, fmt.Errorf("SCT has unsupported version %d", response.SCTVersion)
+	}
+	if !bytes.Equal(response.ID, srv.logID[:]) {
+		return nil, nil, fmt.Errorf("SCT has log ID %x instead of %x", response.ID, srv.logID[:])
+	}
+	return request.Chain, response, nil
+}
+
+// verifySCT verifies the signature of the SCT returned for the given chain
+func (srv *Server) verifySCT(precert bool, chain [][]byte, response *addChainResponse) error {
+	var entryType uint16
+	var signedEntry []byte
+	if precert {
+		entryType = 1
+		if preCert, err := precertSignedEntry(chain); err != nil {
+			return fmt.Errorf("error reconstructing precertificate entry: %w", err)
+		} else {
+			signedEntry = preCert
+		}
+	} else {
+		b := cryptobyte.NewBuilder(nil)
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(chain[0])
+		})
+		signedEntry = b.BytesOrPanic()
+	}
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(0) // sct_version = v1
+	b.AddUint8(0) // signature_type = certificate_timestamp
+	b.AddUint64(response.Timestamp)
+	b.AddUint16(entryType)
+	b.AddBytes(signedEntry)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(response.Extensions)
+	})
+	return verifyDigitallySigned(srv.logKey, b.BytesOrPanic(), response.Signature)
+}
+
+func (srv *Server) storeSubmission(ctx context.Context, precert bool, chain [][]byte, response *addChainResponse) error {
+	leafIndex, ok, err := sctLeafIndex(response.Extensions)
+	if err != nil {
+		return err
+	} else if !ok {
+		return errors.New("SCT is missing LeafIndex extension")
+	}
+	certSHA256 := sha256.Sum256(chain[0])
+	return srv.submissions.PutSubmission(ctx, &Submission{LeafIndex: leafIndex, CertSHA256: certSHA256[:], Precert: precert, Timestamp: response.Timestamp})
+}
+
+// checkSubmissions checks recorded submissions against sth, raising an alert
+// if a submission is not incorporated at the promised leaf index once the MMD
+// has elapsed, or if a different entry is at its leaf index
+func (srv *Server) checkSubmissions(ctx context.Context, sth *signedTreeHead) error {
+	pending, err := srv.submissions.LoadDueSubmissions(ctx, sth.TreeSize, sth.Timestamp, srv.mmd)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range pending {
+		if sub.LeafIndex >= sth.TreeSize {
+			srv.raiseAlert(ctx, &Alert{
+				Type:       "unincorporated_sct",
+				Message:    fmt.Sprintf("SCT with timestamp %d promised leaf index %d, but the tree has size %d after the MMD (%s) elapsed", sub.Timestamp, sub.LeafIndex, sth.TreeSize, srv.mmd),
+				Checkpoint: string(sth.checkpoint),
+			})
+			if err := srv.submissions.MarkSubmissionOverdue(ctx, sub.LeafIndex, sub.CertSHA256); err != nil {
+				return err
+			}
+			continue
+		}
+		entries, err := srv.downloadDataTile(ctx, sth, sub.LeafIndex/entriesPerTile, sub.LeafIndex%entriesPerTile, 1)
+		if err != nil {
+			return fmt.Errorf("error downloading entry %d: %w", sub.LeafIndex, err)
+		}
+		if err := srv.checkEntries(ctx, sth, sub.LeafIndex, entries); err != nil {
+			return err
+		}
+		e := &entries[0]
+		if certSHA256 := e.certSHA256(); !bytes.Equal(certSHA256[:], sub.CertSHA256) || (e.precertificate != nil) != sub.Precert || e.timestamp() != sub.Timestamp {
+			srv.raiseAlert(ctx, &Alert{
+				Type:       "sct_mismatch",
+				Message:    fmt.Sprintf("SCT with timestamp %d for certificate %x promised leaf index %d, but that entry has timestamp %d and certificate %x", sub.Timestamp, sub.CertSHA256, sub.LeafIndex, e.timestamp(), certSHA256[:]),
+				Checkpoint: string(sth.checkpoint),
+			})
+		}
+		if err := srv.submissions.DeleteSubmission(ctx, sub.LeafIndex, sub.CertSHA256); err != nil {
+			return err
+		}
+	}
+	return nil
+}
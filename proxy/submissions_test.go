@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestCA(t *testing.T, name string, parent *testCA, extKeyUsage ...asn1.ObjectIdentifier) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Unix(1700000000, 0),
+		NotAfter:              time.Unix(1800000000, 0),
+		KeyUsage:              x509.KeyUsageCertSign,
+		UnknownExtKeyUsage:    extKeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          []byte(name),
+	}
+	ca := &testCA{key: key}
+	issuer, issuerKey := template, crypto.Signer(key)
+	if parent != nil {
+		issuer, issuerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+// issue returns a leaf certificate for example.com with the given extra
+// extensions, which is identical for the same serial number and extensions
+func (ca *testCA) issue(t *testing.T, key crypto.PublicKey, serial int64, extensions ...pkix.Extension) []byte {
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(serial),
+		Subject:         pkix.Name{CommonName: "example.com"},
+		DNSNames:        []string{"example.com", "www.example.com"},
+		NotBefore:       time.Unix(1700000000, 0),
+		NotAfter:        time.Unix(1710000000, 0),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtraExtensions: extensions,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+var poisonExtension = pkix.Extension{Id: oidPoison, Critical: true, Value: asn1.NullBytes}
+
+// signSCT returns the response to add-chain or add-pre-chain, signed by
+// signer, for an entry with the given type and signed_entry, encoded
+// independently of the code under test
+func signSCT(t *testing.T, signer crypto.Signer, timestamp uint64, entryType uint16, signedEntry []byte, extensions []byte) *addChainResponse {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(0) // sct_version
+	b.AddUint8(0) // signature_type
+	b.AddUint64(timestamp)
+	b.AddUint16(entryType)
+	b.AddBytes(signedEntry)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(extensions) })
+	signature, err := signDigitallySigned(signer, b.BytesOrPanic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logID := LogID(sha256.Sum256(marshalPublicKey(t, signer.Public())))
+	return &addChainResponse{ID: logID[:], Timestamp: timestamp, Extensions: extensions, Signature: signature}
+}
+
+// preCertEntry encodes a PreCert structure from the issuer's key and the TBSCertificate
+func preCertEntry(issuer *x509.Certificate, tbs []byte) []byte {
+	issuerKeyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	b := cryptobyte.NewBuilder(issuerKeyHash[:])
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(tbs) })
+	return b.BytesOrPanic()
+}
+
+func TestVerifySCT(t *testing.T) {
+	for name, logKey := range generateTestKeys(t) {
+		t.Run(name, func(t *testing.T) {
+			srv := &Server{logKey: logKey.Public()}
+			root := newTestCA(t, "Root", nil)
+			ca := newTestCA(t, "Intermediate", root)
+			preSigner := newTestCA(t, "Precertificate Signer", ca, oidPrecertSigning)
+			leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The log signs the TBSCertificate of the final certificate,
+			// which is issued directly by ca and has no poison extension.
+			// The extension list of the final certificate must otherwise
+			// match the precertificate's, so it has no SCT list here.
+			final, err := x509.ParseCertificate(ca.issue(t, leafKey.Public(), 42))
+			if err != nil {
+				t.Fatal(err)
+			}
+			certEntry := cryptobyte.NewBuilder(nil)
+			certEntry.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(final.Raw) })
+			precertSCT := signSCT(t, logKey, 1700000000123, 1, preCertEntry(ca.cert, final.RawTBSCertificate), nil)
+			certSCT := signSCT(t, logKey, 1700000000456, 0, certEntry.BytesOrPanic(), []byte{0, 0, 5, 0, 0, 0, 0, 7})
+
+			directPrecert := ca.issue(t, leafKey.Public(), 42, poisonExtension)
+			delegatedPrecert := preSigner.issue(t, leafKey.Public(), 42, poisonExtension)
+			otherPrecert := ca.issue(t, leafKey.Public(), 43, poisonExtension)
+			tampered := *precertSCT
+			tampered.Timestamp++
+
+			tests := []struct {
+				name     string
+				precert  bool
+				chain    [][]byte
+				response *addChainResponse
+				valid    bool
+			}{
+				{"certificate", false, [][]byte{final.Raw, ca.cert.Raw}, certSCT, true},
+				{"precertificate", true, [][]byte{directPrecert, ca.cert.Raw, root.cert.Raw}, precertSCT, true},
+				{"precertificate signing certificate", true, [][]byte{delegatedPrecert, preSigner.cert.Raw, ca.cert.Raw, root.cert.Raw}, precertSCT, true},
+				{"precertificate signing certificate without its issuer", true, [][]byte{delegatedPrecert, preSigner.cert.Raw}, precertSCT, false},
+				{"precertificate signing certificate treated as issuer", true, [][]byte{delegatedPrecert, ca.cert.Raw}, precertSCT, false},
+				{"different precertificate", true, [][]byte{otherPrecert, ca.cert.Raw}, precertSCT, false},
+				{"wrong issuer", true, [][]byte{directPrecert, root.cert.Raw}, precertSCT, false},
+				{"precertificate SCT for certificate", false, [][]byte{final.Raw, ca.cert.Raw}, precertSCT, false},
+				{"tampered timestamp", true, [][]byte{directPrecert, ca.cert.Raw}, &tampered, false},
+				{"missing issuer", true, [][]byte{directPrecert}, precertSCT, false},
+			}
+			for _, test := range tests {
+				if err := srv.verifySCT(test.precert, test.chain, test.response); test.valid && err != nil {
+					t.Errorf("%s: verifySCT failed: %s", test.name, err)
+				} else if !test.valid && err == nil {
+					t.Errorf("%s: verifySCT succeeded", test.name)
+				}
+			}
+		})
+	}
+}
+
+func TestRewriteTBS(t *testing.T) {
+	ca := newTestCA(t, "Intermediate", nil)
+	preSigner := newTestCA(t, "Precertificate Signer", ca, oidPrecertSigning)
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	final, err := x509.ParseCertificate(ca.issue(t, leafKey.Public(), 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a delegated precertificate has the issuer and authority key
+	// identifier of the precertificate signing certificate, which are
+	// replaced by those of the CA
+	precert, err := x509.ParseCertificate(preSigner.issue(t, leafKey.Public(), 7, poisonExtension))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(precert.RawIssuer, final.RawIssuer) || bytes.Equal(precert.AuthorityKeyId, final.AuthorityKeyId) {
+		t.Fatal("precertificate and final certificate have the same issuer")
+	}
+	if tbs, err := rewriteTBS(precert.Raw, oidPoison, preSigner.cert); err != nil {
+		t.Errorf("error rewriting TBSCertificate: %s", err)
+	} else if !bytes.Equal(tbs, final.RawTBSCertificate) {
+		t.Errorf("rewritten TBSCertificate doesn't match the final certificate:\n%x\n%x", tbs, final.RawTBSCertificate)
+	}
+
+	// if the precertificate signing certificate has no authority key
+	// identifier, neither does the final certificate
+	noAKISigner := *preSigner.cert
+	noAKISigner.Extensions = slices.DeleteFunc(slices.Clone(noAKISigner.Extensions), func(extension pkix.Extension) bool {
+		return extension.Id.Equal(oidAuthorityKeyIdentifier)
+	})
+	noSKICA := &testCA{key: ca.key, cert: new(x509.Certificate)}
+	*noSKICA.cert = *ca.cert
+	noSKICA.cert.SubjectKeyId = nil
+	finalNoAKI, err := x509.ParseCertificate(noSKICA.issue(t, leafKey.Public(), 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finalNoAKI.AuthorityKeyId != nil {
+		t.Fatal("final certificate has an authority key identifier")
+	}
+	if tbs, err := rewriteTBS(precert.Raw, oidPoison, &noAKISigner); err != nil {
+		t.Errorf("error rewriting TBSCertificate: %s", err)
+	} else if !bytes.Equal(tbs, finalNoAKI.RawTBSCertificate) {
+		t.Errorf("rewritten TBSCertificate doesn't match the final certificate without an authority key identifier:\n%x\n%x", tbs, finalNoAKI.RawTBSCertificate)
+	}
+
+	// the final certificate for a precertificate entry is found by removing the SCT list
+	sctList := pkix.Extension{Id: oidSCTList, Value: []byte{0x04, 0x02, 0x00, 0x00}}
+	withSCTs := ca.issue(t, leafKey.Public(), 7, sctList)
+	if tbs, err := reconstructPrecertTBS(withSCTs); err != nil {
+		t.Errorf("error reconstructing precertificate TBSCertificate: %s", err)
+	} else if !bytes.Equal(tbs, final.RawTBSCertificate) {
+		t.Errorf("reconstructed TBSCertificate doesn't match:\n%x\n%x", tbs, final.RawTBSCertificate)
+	}
+
+	if _, err := rewriteTBS([]byte("garbage"), oidPoison, nil); err == nil {
+		t.Error("rewriteTBS accepted a malformed certificate")
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"golang.org/x/mod/sumdb/tlog"
+	"sync"
+)
+
+// tileCache is a bounded in-memory LRU cache of full tiles, used when
+// the storage doesn't implement TileStorage
+type tileCache struct {
+	mu       sync.Mutex
+	capacity int
+	lru      *list.List // of *tileCacheEntry; most recently used at front
+	entries  map[tileKey]*list.Element
+}
+
+type tileKey struct {
+	level  int
+	number int64
+}
+
+type tileCacheEntry struct {
+	key  tileKey
+	data []byte
+}
+
+func newTileCache(capacity int) *tileCache {
+	return &tileCache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[tileKey]*list.Element),
+	}
+}
+
+func (cache *tileCache) get(key tileKey) ([]byte, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	elem, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	cache.lru.MoveToFront(elem)
+	return elem.Value.(*tileCacheEntry).data, true
+}
+
+func (cache *tileCache) put(key tileKey, data []byte) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if elem, ok := cache.entries[key]; ok {
+		cache.lru.MoveToFront(elem)
+		return
+	}
+	cache.entries[key] = cache.lru.PushFront(&tileCacheEntry{key: key, data: data})
+	for cache.lru.Len() > cache.capacity {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*tileCacheEntry).key)
+	}
+}
+
+func isFullTile(tile tlog.Tile) bool {
+	return tile.W == entriesPerTile
+}
+
+// loadTile returns the cached contents of the given full tile, if available.
+// In mirror mode or with local proofs, partial tiles are also available.
+func (srv *Server) loadTile(ctx context.Context, tile tlog.Tile) ([]byte, bool, error) {
+	if !isFullTile(tile) {
+		return srv.loadPartialTile(ctx, tile)
+	}
+	if srv.tiles == nil {
+		data, ok := srv.tileCache.get(tileKey{level: tile.L, number: tile.N})
+		return data, ok, nil
+	}
+	return srv.tiles.LoadTile(ctx, tile)
+}
+
+// storeTile caches the contents of the given full tile, which must have been
+// verified.  In mirror mode or with local proofs, partial tiles are also stored.
+func (srv *Server) storeTile(ctx context.Context, tile tlog.Tile, data []byte) error {
+	if !isFullTile(tile) {
+		return srv.storePartialTile(ctx, tile, data)
+	}
+	if srv.tiles == nil {
+		srv.tileCache.put(tileKey{level: tile.L, number: tile.N}, data)
+		return nil
+	}
+	return srv.tiles.StoreTile(ctx, tile, data)
+}
+
+// storesPartialTiles reports whether partial tiles are stored, which is the
+// case in mirror mode and when computing proofs locally
+func (srv *Server) storesPartialTiles() bool {
+	return srv.mirror || srv.localProofs
+}
+
+// loadPartialTile returns the contents of the given partial tile, if stored.
+// Only the widest version of each partial tile is stored; hash tiles are
+// truncated to the requested width, but data tiles are returned in full since
+// their entries have variable length.  If the tile has since become full, the
+// full tile is used.
+func (srv *Server) loadPartialTile(ctx context.Context, tile tlog.Tile) ([]byte, bool, error) {
+	if !srv.storesPartialTiles() {
+		return nil, false, nil
+	}
+	data, ok, err := srv.tiles.LoadTile(ctx, tile)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	if tile.L >= 0 {
+		data = data[:tile.W*merkleHashLen]
+	}
+	return data, true, nil
+}
+
+func (srv *Server) storePartialTile(ctx context.Context, tile tlog.Tile, data []byte) error {
+	if !srv.storesPartialTiles() {
+		return nil
+	}
+	return srv.tiles.StoreTile(ctx, tile, data)
+}
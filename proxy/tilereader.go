@@ -2,16 +2,18 @@ package proxy
 
 import (
 	"context"
+	"fmt"
 	"golang.org/x/mod/sumdb/tlog"
 	"golang.org/x/sync/errgroup"
-	"net/url"
 	"strconv"
+	"sync"
 )
 
 type tileReader struct {
-	ctx       context.Context
-	prefix    *url.URL
-	userAgent string
+	ctx        context.Context
+	srv        *Server
+	offline    bool     // only read tiles from local storage (mirror mode, and local proofs)
+	downloaded sync.Map // tlog.Tile -> struct{}; tiles which weren't in the cache
 }
 
 func (*tileReader) Height() int {
@@ -24,25 +26,59 @@ func (reader *tileReader) ReadTiles(tiles []tlog.Tile) ([][]byte, error) {
 	group.SetLimit(100)
 	for i := range tiles {
 		group.Go(func() error {
+			if data, ok, err := reader.srv.loadTile(ctx, tiles[i]); err != nil {
+				return err
+			} else if ok {
+				tileData[i] = data
+				return nil
+			} else if reader.offline {
+				return fmt.Errorf("tile %s is not stored locally", tiles[i].Path())
+			}
 			tilePath := formatTilePath(
 				strconv.FormatInt(int64(tiles[i].L), 10),
 				uint64(tiles[i].N),
 				uint64(tiles[i].W),
 			)
-			tileURL := reader.prefix.JoinPath(tilePath)
-			if resp, err := downloadRetry(ctx, reader.userAgent, tileURL.String()); err != nil {
+			tileURL := reader.srv.monitoringPrefix.JoinPath(tilePath)
+			if resp, err := reader.srv.downloadRetry(ctx, tileURL.String()); err != nil {
 				return err
 			} else {
 				tileData[i] = resp
+				reader.downloaded.Store(tiles[i], struct{}{})
 			}
 			return nil
 		})
 	}
 	if err := group.Wait(); err != nil {
-		return nil, err
+		return nil, tileReadError{err}
 	}
 	return tileData, nil
 }
 
-func (*tileReader) SaveTiles([]tlog.Tile, [][]byte) {
+// tileReadError is returned by ReadTiles, to distinguish tiles which couldn't
+// be read from tiles which tlog.TileHashReader couldn't verify
+type tileReadError struct {
+	error
+}
+
+func (e tileReadError) Unwrap() error {
+	return e.error
+}
+
+// SaveTiles is called by tlog.TileHashReader with tiles that have been
+// verified against the tree head.  Full tiles are immutable, so we cache them.
+// In mirror mode or with local proofs, partial tiles are stored too.  Tiles
+// which were already stored aren't stored again.
+func (reader *tileReader) SaveTiles(tiles []tlog.Tile, data [][]byte) {
+	for i := range tiles {
+		if !isFullTile(tiles[i]) && !reader.srv.storesPartialTiles() {
+			continue
+		}
+		if _, downloaded := reader.downloaded.Load(tiles[i]); !downloaded {
+			continue
+		}
+		if err := reader.srv.storeTile(reader.ctx, tiles[i], data[i]); err != nil {
+			reader.srv.log.Printf("error caching tile %s: %s", tiles[i].Path(), err)
+		}
+	}
 }